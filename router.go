@@ -47,11 +47,12 @@ const subsNATSPath = "$1.*>"
 
 func fromNatsPath(path string) string {
 	i := 0
-	path = reNATSPathToken.ReplaceAllStringFunc(path, func(string) string {
+	// Prefix a '.' so that a leading '*' token is rewritten as well
+	path = reNATSPathToken.ReplaceAllStringFunc("."+path, func(string) string {
 		i++
 
 		return fmt.Sprintf(".:p%d", i)
-	})
+	})[1:]
 	result := reNATSPathCatchAll.ReplaceAllString(path, subsNATSPath)
 
 	return result
@@ -83,6 +84,13 @@ type Router struct {
 	// registered when this option was enabled.
 	SaveMatchedRoutePath bool
 
+	// If enabled, the leading '.' is stripped from the value captured by a
+	// catch-all wildcard, e.g. "user.>" matching "user.gopher.ok" yields
+	// "gopher.ok" instead of ".gopher.ok".
+	// The leading '.' is kept by default for compatibility with existing
+	// consumers of ps.ByName(">"). It behaves as in the v2 module.
+	TrimCatchAllDot bool
+
 	// Cached value of global (*) allowed ranks
 	globalAllowed string
 
@@ -188,7 +196,7 @@ func (r *Router) Handle(path string, rank int, handle Handle) {
 // values.
 func (r *Router) Lookup(path string, rank int) (Handle, Params, bool) {
 	if root := r.trees[rank]; root != nil {
-		handle, ps, tsr := root.getValue(path, r.getParams)
+		handle, ps, tsr := root.getValue(path, r.getParams, r.TrimCatchAllDot)
 		if handle == nil {
 			r.putParams(ps)
 
@@ -224,7 +232,7 @@ func (r *Router) allowed(path string, reqRank int) (allow string) {
 				continue
 			}
 
-			handle, _, _ := r.trees[rank].getValue(path, nil)
+			handle, _, _ := r.trees[rank].getValue(path, nil, false)
 			if handle != nil {
 				// Add request rank to list of allowed ranks
 				allowed = append(allowed, rank)
@@ -285,7 +293,7 @@ func (r *Router) ServeNATS(msg *nats.Msg) error {
 	rankList := r.getRankList()
 	for _, rank := range rankList {
 		if root := r.trees[rank]; root != nil {
-			if handle, ps, _ := root.getValue(path, r.getParams); handle != nil {
+			if handle, ps, _ := root.getValue(path, r.getParams, r.TrimCatchAllDot); handle != nil {
 				if ps != nil {
 					go func() {
 						handle(msg, *ps, nil)
@@ -315,7 +323,7 @@ func (r *Router) ServeNATSWithPayload(msg *nats.Msg, payload interface{}) error
 	rankList := r.getRankList()
 	for _, rank := range rankList {
 		if root := r.trees[rank]; root != nil {
-			if handle, ps, _ := root.getValue(path, r.getParams); handle != nil {
+			if handle, ps, _ := root.getValue(path, r.getParams, r.TrimCatchAllDot); handle != nil {
 				if ps != nil {
 					go func() {
 						handle(msg, *ps, payload)
@@ -26,6 +26,27 @@ func catchPanic(testFunc func()) (recv interface{}) {
 func TestPathCathAll(t *testing.T) {
 	assert.Equal(t, "user.*>", fromNatsPath("user.>"))
 	assert.Equal(t, "user.:p1.:p2.*>", fromNatsPath("user.*.*.>"))
+	assert.Equal(t, ":p1.foo", fromNatsPath("*.foo"))
+}
+
+func TestRouterLeadingToken(t *testing.T) {
+	router := New()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	routed := false
+	router.Handle("*.foo", 1, func(msg *nats.Msg, ps Params, _ interface{}) {
+		defer wg.Done()
+		routed = true
+		want := Params{Param{"p1", "gopher"}}
+		if !reflect.DeepEqual(ps, want) {
+			t.Fatalf("wrong wildcard values: want %v, got %v", want, ps)
+		}
+	})
+
+	_ = router.ServeNATS(&nats.Msg{Subject: "gopher.foo"})
+	wg.Wait()
+	assert.True(t, routed)
 }
 
 func TestParams(t *testing.T) {
@@ -100,6 +121,37 @@ func TestRouterCatchAll(t *testing.T) {
 	}
 }
 
+// The catch-all value is the same in v1 and v2: keep this test in sync with
+// its copy in the other module's router_test.go.
+func TestRouterCatchAllValueParity(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		rank             int
+		value, trimmed   string
+	}{
+		{"user.>", "user.gopher", 1, ".gopher", "gopher"},
+		{"user.>", "user.gopher.star.ok", 4, ".gopher.star.ok", "gopher.star.ok"},
+		{"user.*.v1.>", "user.gopher.v1.ok", 2, ".ok", "ok"},
+	}
+
+	for _, trim := range []bool{false, true} {
+		router := New()
+		router.TrimCatchAllDot = trim
+		for _, tt := range tests {
+			router.Handle(tt.pattern, tt.rank, func(_ *nats.Msg, _ Params, _ interface{}) {})
+		}
+		for _, tt := range tests {
+			handle, ps, _ := router.Lookup(tt.subject, tt.rank)
+			assert.NotNil(t, handle, tt.pattern)
+			want := tt.value
+			if trim {
+				want = tt.trimmed
+			}
+			assert.Equal(t, want, ps.ByName(">"), "%s with TrimCatchAllDot=%t", tt.pattern, trim)
+		}
+	}
+}
+
 func TestRouterMulti(t *testing.T) {
 	router := New()
 	var wg sync.WaitGroup
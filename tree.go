@@ -331,7 +331,8 @@ func (n *node) insertChild(path, fullPath string, handle Handle) {
 // If no handle can be found, a TSR (trailing slash redirect) recommendation is
 // made if a handle exists with an extra (without the) trailing slash for the
 // given path.
-func (n *node) getValue(path string, params func() *Params) (handle Handle, ps *Params, tsr bool) {
+// If trimCatchAll is set, the leading '.' is stripped from the catch-all value.
+func (n *node) getValue(path string, params func() *Params, trimCatchAll bool) (handle Handle, ps *Params, tsr bool) {
 walk: // Outer loop for walking the tree
 	for {
 		prefix := n.path
@@ -411,17 +412,26 @@ walk: // Outer loop for walking the tree
 					return
 
 				case catchAll:
+					// The catch-all node path starts with the '.' separator
+					// (e.g. ".*>"), so the remainder captured here keeps it.
+					// This is intended, not an off-by-one: it mirrors the
+					// leading '/' of httprouter catch-all values and lets
+					// consumers rebuild the subject by concatenation.
 					// Save param value
 					if params != nil {
 						if ps == nil {
 							ps = params()
 						}
+						value := path
+						if trimCatchAll {
+							value = path[1:]
+						}
 						// Expand slice within preallocated capacity
 						i := len(*ps)
 						*ps = (*ps)[:i+1]
 						(*ps)[i] = Param{
 							Key:   n.path[2:],
-							Value: path,
+							Value: value,
 						}
 					}
 
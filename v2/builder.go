@@ -0,0 +1,132 @@
+package natsrouter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Builder constructs a Router fluently, collecting its options and routes so
+// that the whole configuration is checked at once by Build:
+//
+//	router, err := natsrouter.NewBuilder().
+//		WithPanicHandler(onPanic).
+//		SaveMatchedRoutePath().
+//		Handle("user.*.ping", 1, ping).
+//		Build()
+//
+// A Builder is not safe for concurrent use.
+type Builder struct {
+	options        []func(*Router)
+	routes         []builderRoute
+	maxConcurrency int
+	errs           []error
+}
+
+type builderRoute struct {
+	path   string
+	rank   int
+	handle Handle
+}
+
+// NewBuilder returns a new Builder of a Router with the defaults of New.
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// With sets options of the Router not covered by the other methods, e.g.
+// func(r *natsrouter.Router) { r.NotFoundAsync = true }.
+// Options are applied in order, before any route is registered.
+func (b *Builder) With(option func(*Router)) *Builder {
+	if option == nil {
+		b.errs = append(b.errs, errors.New("option must not be nil"))
+
+		return b
+	}
+	b.options = append(b.options, option)
+
+	return b
+}
+
+// WithPanicHandler sets the PanicHandler of the Router.
+func (b *Builder) WithPanicHandler(handler func(SubjectMsg, interface{})) *Builder {
+	if handler == nil {
+		b.errs = append(b.errs, errors.New("panic handler must not be nil"))
+
+		return b
+	}
+
+	return b.With(func(r *Router) { r.PanicHandler = handler })
+}
+
+// WithMaxConcurrency limits the handles of the Router running concurrently
+// to n overall, by bounding its Executor with BoundedExecutor. The routes
+// served in the calling goroutine or on the workers of OrderingKey are not
+// counted, nor the concurrent handles of HandleMulti, which bypass it.
+func (b *Builder) WithMaxConcurrency(n int) *Builder {
+	if n <= 0 {
+		b.errs = append(b.errs, fmt.Errorf("max concurrency must be > 0, got %d", n))
+
+		return b
+	}
+	b.maxConcurrency = n
+
+	return b
+}
+
+// SaveMatchedRoutePath enables SaveMatchedRoutePath on the Router.
+func (b *Builder) SaveMatchedRoutePath() *Builder {
+	return b.With(func(r *Router) { r.SaveMatchedRoutePath = true })
+}
+
+// Handle registers a new request handle with the given path and rank on the
+// Router, once its options are set.
+func (b *Builder) Handle(path string, rank int, handle Handle) *Builder {
+	b.routes = append(b.routes, builderRoute{path: path, rank: rank, handle: handle})
+
+	return b
+}
+
+// Build returns the configured Router, or the errors of its configuration:
+// invalid arguments, routes which cannot be registered, as with HandleE, and
+// the errors of Validate, joined.
+func (b *Builder) Build() (*Router, error) {
+	errs := append([]error(nil), b.errs...)
+
+	r := New()
+	for _, option := range b.options {
+		option(r)
+	}
+	if b.maxConcurrency > 0 {
+		r.Executor = BoundedExecutor(r.Executor, b.maxConcurrency)
+	}
+	for _, route := range b.routes {
+		if err := b.register(r, route); err != nil {
+			errs = append(errs, fmt.Errorf("route '%s' on rank %d: %w", route.path, route.rank, err))
+		}
+	}
+	if err := r.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// register registers a route on r, turning panics into errors.
+func (b *Builder) register(r *Router, route builderRoute) (err error) {
+	if route.handle == nil {
+		return ErrNilHandler
+	}
+
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("%v", rcv)
+		}
+	}()
+	r.Handle(route.path, route.rank, route.handle)
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package natsrouter
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lookupEntry is a match cached by subject, see Router.LookupCacheSize.
+type lookupEntry struct {
+	path   string
+	handle Handle
+	leaf   *node
+	rank   int
+	// A private copy of the params, never a pooled slice
+	params Params
+}
+
+// lookupCache is a fixed size LRU cache of matches.
+// It is safe for concurrent use.
+type lookupCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+func newLookupCache(size int) *lookupCache {
+	return &lookupCache{
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lookupCache) get(path string) (*lookupEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+
+	return el.Value.(*lookupEntry), true
+}
+
+func (c *lookupCache) add(entry *lookupEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[entry.path]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+
+		return
+	}
+	c.entries[entry.path] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupEntry).path)
+	}
+}
+
+func (c *lookupCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element, c.size)
+}
+
+// getLookupCache returns the lookup cache, or nil if disabled.
+// The caller must hold r.mu.
+func (r *Router) getLookupCache() *lookupCache {
+	if r.LookupCacheSize <= 0 {
+		return nil
+	}
+	r.lookupCacheOnce.Do(func() {
+		r.lookupCache = newLookupCache(r.LookupCacheSize)
+	})
+
+	return r.lookupCache
+}
+
+// invalidateLookupCache drops all cached matches after a routing table
+// change. The caller must hold r.mu for writing.
+func (r *Router) invalidateLookupCache() {
+	if r.lookupCache != nil {
+		r.lookupCache.clear()
+	}
+}
@@ -0,0 +1,209 @@
+package natsrouter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ContentTypeHeader is the message header selecting the Codec of its data.
+const ContentTypeHeader = "Content-Type"
+
+// ContentTypeJSON is the content type of JSONCodec, used for messages
+// without a ContentTypeHeader unless Router.DefaultContentType is set.
+const ContentTypeJSON = "application/json"
+
+// ErrUnknownContentType is returned when no Codec is registered for the
+// content type of a message.
+var ErrUnknownContentType = errors.New("unknown content type")
+
+// ErrNoData is returned when the data of a message cannot be accessed,
+// see DataMsg.
+var ErrNoData = errors.New("message has no data")
+
+// Codec encodes and decodes message data of a content type.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// JSONCodec is the Codec of ContentTypeJSON, available on every Router.
+var JSONCodec Codec = jsonCodec{}
+
+// DataMsg is implemented by messages, or the values returned by their GetMsg,
+// which carry data and headers, like nrtest.Msg and nrhttp.Msg.
+// *nats.Msg is supported as well.
+type DataMsg interface {
+	GetData() []byte
+	GetHeader(key string) string
+}
+
+// Headerer is implemented by messages, or the values returned by their
+// GetMsg, which carry headers, like nrtest.Msg and nrhttp.Msg.
+// *nats.Msg is supported as well.
+type Headerer interface {
+	Headers() map[string][]string
+}
+
+// FromHeaders returns the headers of msg, whatever its concrete type, or nil
+// if it carries none. It is a method of Params so that handlers can access
+// the headers along with the params of the subject.
+func (ps Params) FromHeaders(msg SubjectMsg) map[string][]string {
+	if natsMsg, ok := msg.GetMsg().(*nats.Msg); ok {
+		return natsMsg.Header
+	}
+
+	headerer, ok := msg.(Headerer)
+	if !ok {
+		if headerer, ok = msg.GetMsg().(Headerer); !ok {
+			return nil
+		}
+	}
+
+	return headerer.Headers()
+}
+
+// msgData returns the data and content type of msg.
+func msgData(msg SubjectMsg) (data []byte, contentType string, err error) {
+	if natsMsg, ok := msg.GetMsg().(*nats.Msg); ok {
+		return natsMsg.Data, natsMsg.Header.Get(ContentTypeHeader), nil
+	}
+
+	dataMsg, ok := msg.(DataMsg)
+	if !ok {
+		if dataMsg, ok = msg.GetMsg().(DataMsg); !ok {
+			return nil, "", ErrNoData
+		}
+	}
+
+	return dataMsg.GetData(), dataMsg.GetHeader(ContentTypeHeader), nil
+}
+
+// RegisterCodec registers the Codec used for messages of the given content
+// type, replacing any previous one, including JSONCodec.
+func (r *Router) RegisterCodec(contentType string, c Codec) {
+	if c == nil {
+		panic("codec must not be nil")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.codecs == nil {
+		r.codecs = make(map[string]Codec)
+	}
+	r.codecs[mediaType(contentType)] = c
+}
+
+// Codec returns the Codec registered for the given content type.
+// Media type parameters, like "; charset=utf-8", are ignored, and an empty
+// content type stands for Router.DefaultContentType.
+func (r *Router) Codec(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = r.DefaultContentType
+	}
+	contentType = mediaType(contentType)
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	r.mu.RLock()
+	c, ok := r.codecs[contentType]
+	r.mu.RUnlock()
+	if ok {
+		return c, nil
+	}
+	if contentType == ContentTypeJSON {
+		return JSONCodec, nil
+	}
+
+	return nil, fmt.Errorf("%w '%s'", ErrUnknownContentType, contentType)
+}
+
+// mediaType strips the parameters of a content type.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Decode unmarshals the data of msg into v, with the Codec of its content
+// type.
+func (r *Router) Decode(msg SubjectMsg, v interface{}) error {
+	data, contentType, err := msgData(msg)
+	if err != nil {
+		return err
+	}
+	c, err := r.Codec(contentType)
+	if err != nil {
+		return err
+	}
+
+	return c.Unmarshal(data, v)
+}
+
+// Respond marshals v with the Codec of the content type of msg and answers
+// msg with it. The message or the value returned by its GetMsg must
+// implement Responder.
+func (r *Router) Respond(msg SubjectMsg, v interface{}) error {
+	_, contentType, err := msgData(msg)
+	if err != nil && !errors.Is(err, ErrNoData) {
+		return err
+	}
+	c, err := r.Codec(contentType)
+	if err != nil {
+		return err
+	}
+	data, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	responder, ok := msg.(Responder)
+	if !ok {
+		if responder, ok = msg.GetMsg().(Responder); !ok {
+			return fmt.Errorf("message of type %T cannot respond", msg)
+		}
+	}
+
+	return responder.Respond(data)
+}
+
+// HandleDecoded registers a new request handle with the given path and rank,
+// whose payload is the message data decoded into the value returned by
+// newValue, e.g. func() interface{} { return new(User) }.
+// The Codec is chosen by the content type of the message, see Decode.
+// Messages which cannot be decoded are reported to the ErrorHandler and the
+// handle is not run.
+func (r *Router) HandleDecoded(path string, rank int, newValue func() interface{}, handle Handle) {
+	if newValue == nil || handle == nil {
+		panic("handle must not be nil")
+	}
+
+	r.Handle(path, rank, func(msg SubjectMsg, ps Params, _ interface{}) {
+		v := newValue()
+		if err := r.Decode(msg, v); err != nil {
+			if r.ErrorHandler != nil {
+				r.ErrorHandler(msg, fmt.Errorf("decode '%s': %w", msg.GetSubject(), err))
+			}
+
+			return
+		}
+		handle(msg, ps, v)
+	})
+}
@@ -0,0 +1,88 @@
+package natsrouter
+
+import (
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ReplyHandle is a handle returning a result, see HandleEmit.
+type ReplyHandle func(SubjectMsg, Params, interface{}) ([]byte, error)
+
+// Replier is implemented by messages, or the values returned by their GetMsg,
+// which tell the subject to reply to, like nrtest.Msg.
+// *nats.Msg is supported as well.
+type Replier interface {
+	GetReply() string
+}
+
+// responder returns the Responder of a message with a reply subject.
+// Responders which do not tell their reply subject are assumed to have one.
+func responder(msg SubjectMsg) (Responder, bool) {
+	if natsMsg, ok := msg.GetMsg().(*nats.Msg); ok {
+		return natsMsg, natsMsg.Reply != ""
+	}
+	for _, v := range []interface{}{msg, msg.GetMsg()} {
+		if replier, ok := v.(Replier); ok && replier.GetReply() == "" {
+			return nil, false
+		}
+	}
+
+	responder, ok := msg.(Responder)
+	if !ok {
+		responder, ok = msg.GetMsg().(Responder)
+	}
+
+	return responder, ok
+}
+
+// HandleEmit registers a new request handle with the given path and rank,
+// whose result answers the message if it has a reply subject, and is handed
+// to the ResultPublisher otherwise, e.g. to emit an event derived from the
+// one processed. A nil result is neither sent nor published. Errors of the
+// handle, or of the response, are reported to the ErrorHandler.
+func (r *Router) HandleEmit(path string, rank int, handle ReplyHandle) {
+	if handle == nil {
+		panic("handle must not be nil")
+	}
+
+	r.Handle(path, rank, func(msg SubjectMsg, ps Params, payload interface{}) {
+		result, err := handle(msg, ps, payload)
+		if err == nil && result != nil {
+			if responder, ok := responder(msg); ok {
+				err = responder.Respond(result)
+			} else if r.ResultPublisher != nil {
+				r.ResultPublisher(msg.GetSubject(), result)
+			}
+		}
+		if err != nil && r.ErrorHandler != nil {
+			r.ErrorHandler(msg, fmt.Errorf("'%s': %w", msg.GetSubject(), err))
+		}
+	})
+}
+
+// publisher is the part of *nats.Conn used by NatsResultPublisher.
+type publisher interface {
+	Publish(subject string, data []byte) error
+}
+
+// NatsResultPublisher returns a Router.ResultPublisher publishing each result
+// on conn, to the subject derived from the input subject by derive, e.g.
+// func(in string) string { return "events." + in }. Publish errors are
+// passed to onError, if not nil.
+func NatsResultPublisher(conn *nats.Conn, derive func(inSubject string) string, onError func(subject string, err error)) func(inSubject string, result []byte) {
+	return resultPublisher(conn, derive, onError)
+}
+
+func resultPublisher(conn publisher, derive func(string) string, onError func(string, error)) func(string, []byte) {
+	if derive == nil {
+		panic("derive must not be nil")
+	}
+
+	return func(inSubject string, result []byte) {
+		subject := derive(inSubject)
+		if err := conn.Publish(subject, result); err != nil && onError != nil {
+			onError(subject, err)
+		}
+	}
+}
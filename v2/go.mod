@@ -2,10 +2,19 @@ module github.com/mondora/natsrouter/v2
 
 go 1.20
 
-require github.com/stretchr/testify v1.10.0
+require (
+	github.com/nats-io/nats.go v1.36.0
+	github.com/stretchr/testify v1.10.0
+	google.golang.org/protobuf v1.34.2
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/compress v1.17.2 // indirect
+	github.com/nats-io/nkeys v0.4.7 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.25.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,59 @@
+package natsrouter
+
+import "strings"
+
+// interner deduplicates strings, so that equal ones share their backing
+// storage. Each string is counted once per intern, and dropped by the
+// matching release, so that it does not outlive its users.
+// It is not safe for concurrent use.
+type interner map[string]*internedString
+
+type internedString struct {
+	s    string
+	refs int
+}
+
+// intern returns the interned string equal to s, interning a copy of s,
+// which does not retain the storage of s, if there is none.
+func (in interner) intern(s string) string {
+	if interned, ok := in[s]; ok {
+		interned.refs++
+
+		return interned.s
+	}
+	s = strings.Clone(s)
+	in[s] = &internedString{s: s, refs: 1}
+
+	return s
+}
+
+// release drops a reference to the interned string equal to s.
+func (in interner) release(s string) {
+	if interned, ok := in[s]; ok {
+		if interned.refs--; interned.refs == 0 {
+			delete(in, s)
+		}
+	}
+}
+
+// intern returns s interned if InternTokens is set, s itself otherwise.
+// The caller must hold r.mu for writing.
+func (r *Router) intern(s string) string {
+	if !r.InternTokens {
+		return s
+	}
+	if r.interned == nil {
+		r.interned = make(interner)
+	}
+
+	return r.interned.intern(s)
+}
+
+// release drops the references of a route to its interned pattern and path.
+// The caller must hold r.mu for writing.
+func (r *Router) release(route RouteInfo) {
+	if r.interned != nil {
+		r.interned.release(route.Pattern)
+		r.interned.release(route.Path)
+	}
+}
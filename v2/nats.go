@@ -0,0 +1,404 @@
+package natsrouter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsMsg adapts a *nats.Msg to the SubjectMsg interface.
+type NatsMsg struct {
+	Msg *nats.Msg
+}
+
+// NewNatsMsg wraps a *nats.Msg into a SubjectMsg.
+func NewNatsMsg(msg *nats.Msg) SubjectMsg {
+	return &NatsMsg{Msg: msg}
+}
+
+// GetMsg returns the wrapped *nats.Msg.
+func (m *NatsMsg) GetMsg() interface{} {
+	return m.Msg
+}
+
+// GetSubject returns the subject of the wrapped *nats.Msg.
+func (m *NatsMsg) GetSubject() string {
+	return m.Msg.Subject
+}
+
+// Respond replies to the wrapped *nats.Msg.
+func (m *NatsMsg) Respond(data []byte) error {
+	return m.Msg.Respond(data)
+}
+
+// Responder is implemented by messages which can answer a request, like
+// *nats.Msg and NatsMsg.
+type Responder interface {
+	Respond(data []byte) error
+}
+
+// replyNotFound answers a request-reply message which missed all routes with
+// the NotFoundReply data. The message or the value returned by its GetMsg
+// must implement Responder; messages without a reply subject are skipped.
+func (r *Router) replyNotFound(msg SubjectMsg) {
+	if natsMsg, ok := msg.GetMsg().(*nats.Msg); ok && natsMsg.Reply == "" {
+		return
+	}
+
+	responder, ok := msg.(Responder)
+	if !ok {
+		if responder, ok = msg.GetMsg().(Responder); !ok {
+			return
+		}
+	}
+
+	if err := responder.Respond(r.NotFoundReply(msg)); err != nil && r.ErrorHandler != nil {
+		r.ErrorHandler(msg, err)
+	}
+}
+
+// Validate checks that the subjects of all registered routes are legal NATS
+// subscription subjects, e.g. at startup to fail fast on a bad routing table.
+// The returned error lists all offending routes; see Router.Strict to reject
+// them at registration instead.
+func (r *Router) Validate() error {
+	var errs []error
+	for _, route := range r.RoutesInOrder() {
+		if err := validatePattern(toNatsSubject(route.Path)); err != nil {
+			errs = append(errs, fmt.Errorf("route '%s' on rank %d: %w", route.Pattern, route.Rank, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// toNatsSubject converts a path in router notation back to a NATS subject,
+// e.g. "user.:p1.*>" becomes "user.*.>".
+func toNatsSubject(path string) string {
+	tokens := strings.Split(path, ".")
+	for i, token := range tokens {
+		switch {
+		case strings.HasPrefix(token, ":+"):
+			// NATS has no one-or-more wildcard: subscribe to everything below
+			tokens[i] = ">"
+
+			return strings.Join(tokens[:i+1], ".")
+		case strings.HasPrefix(token, ":"):
+			tokens[i] = "*"
+		case strings.HasPrefix(token, "*"):
+			tokens[i] = ">"
+		}
+	}
+
+	return strings.Join(tokens, ".")
+}
+
+// Subjects returns the distinct NATS subjects of all registered routes,
+// ordered by rank and then by registration order.
+// A subject registered on more than one rank is returned only once: the
+// router dispatches it to the right rank internally.
+func (r *Router) Subjects() []string {
+	return r.subjects(false)
+}
+
+// subjects returns the subjects like Subjects, leaving out the subjects of
+// disabled routes if enabledOnly is set.
+func (r *Router) subjects(enabledOnly bool) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	routes := make([]RouteInfo, len(r.routes))
+	copy(routes, r.routes)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Rank < routes[j].Rank
+	})
+
+	seen := make(map[string]struct{}, len(routes))
+	subjects := make([]string, 0, len(routes))
+	for _, rt := range routes {
+		if enabledOnly {
+			if n := r.findNode(rt.Path, rt.Rank); n == nil || n.disabled {
+				continue
+			}
+		}
+		subject := toNatsSubject(rt.Path)
+		if _, ok := seen[subject]; ok {
+			continue
+		}
+		seen[subject] = struct{}{}
+		subjects = append(subjects, subject)
+	}
+
+	return subjects
+}
+
+// MsgHandler returns a nats.MsgHandler serving messages with the router, e.g.
+// nc.Subscribe(">", router.MsgHandler()). Misses are reported to the
+// configured hooks, like NotFoundHandler; errors without a dedicated hook,
+// like ErrSubjectTooLong, are reported to the ErrorHandler.
+func (r *Router) MsgHandler() nats.MsgHandler {
+	return func(natsMsg *nats.Msg) {
+		msg := NewNatsMsg(natsMsg)
+		if err := r.ServeNATS(msg); err != nil && r.ErrorHandler != nil && !r.hooked(err) {
+			r.ErrorHandler(msg, err)
+		}
+	}
+}
+
+// hooked reports whether an error returned by ServeNATS was already handed to
+// a configured hook.
+func (r *Router) hooked(err error) bool {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return r.NotFoundHandler != nil
+	case errors.Is(err, ErrExpired):
+		return r.ExpiredHandler != nil
+	case errors.Is(err, ErrUnauthorized):
+		return r.UnauthorizedHandler != nil
+	}
+
+	return false
+}
+
+// QueueSubscribe subscribes the router to the subjects returned by
+// Subjects, within the given queue group. Like with Subscribe, subjects
+// covered by another one are left out, so that a message is delivered once
+// to the members, unless it matches subjects which only partly overlap.
+// On error, the subscriptions already made are unsubscribed.
+func (r *Router) QueueSubscribe(conn *nats.Conn, queue string) ([]*nats.Subscription, error) {
+	return r.queueSubscribe(conn, queue)
+}
+
+func (r *Router) queueSubscribe(conn subscriber, queue string) ([]*nats.Subscription, error) {
+	_, subs, err := r.subscribeAll(conn, queue)
+
+	return subs, err
+}
+
+// subscriber is the part of *nats.Conn used by Subscribe.
+type subscriber interface {
+	Subscribe(subject string, cb nats.MsgHandler) (*nats.Subscription, error)
+	QueueSubscribe(subject, queue string, cb nats.MsgHandler) (*nats.Subscription, error)
+}
+
+// subscriptions are the subscriptions owned by a router, by subject.
+type subscriptions struct {
+	mu        sync.Mutex
+	conn      subscriber
+	queue     string
+	bySubject map[string]*nats.Subscription
+}
+
+// ErrSubscribed is returned by Subscribe when the router already owns
+// subscriptions.
+var ErrSubscribed = errors.New("router already subscribed")
+
+// Subscribe subscribes the router to the subjects returned by Subjects,
+// within the given queue group, or without one if queue is empty. Subjects
+// covered by another one, like "ROUTING.v2.FEEDBACK.>" by "ROUTING.v2.>",
+// are left out, since NATS would deliver a message once per matching
+// subscription, and the router would serve it as many times. Subjects which
+// only partly overlap, like "x.*.c" and "x.b.*", are both subscribed: a
+// message matching both, like "x.b.c", is delivered and served twice.
+// The subjects of disabled routes are left out as well.
+// Unlike QueueSubscribe, the router owns the subscriptions and keeps them
+// in sync with the routes: the subjects of routes registered or enabled
+// afterwards, e.g. by Handle or Swap, are subscribed on conn as well, so
+// that late registrations are not left unsubscribed, and the subscriptions
+// they cover, or which no enabled route needs anymore, are unsubscribed.
+// Failures to do so are reported to the SubscribeErrorHandler.
+// On error, the subscriptions already made are unsubscribed.
+func (r *Router) Subscribe(conn *nats.Conn, queue string) error {
+	return r.subscribe(conn, queue)
+}
+
+func (r *Router) subscribe(conn subscriber, queue string) error {
+	r.subs.mu.Lock()
+	defer r.subs.mu.Unlock()
+
+	if r.subs.conn != nil {
+		return ErrSubscribed
+	}
+
+	subjects, subs, err := r.subscribeAll(conn, queue)
+	if err != nil {
+		return err
+	}
+	bySubject := make(map[string]*nats.Subscription, len(subs))
+	for i, sub := range subs {
+		bySubject[subjects[i]] = sub
+	}
+	r.subs.conn, r.subs.queue, r.subs.bySubject = conn, queue, bySubject
+
+	return nil
+}
+
+// subscribeAll subscribes the subjects returned by subscribedSubjects on
+// conn, returning them with their subscriptions, in the same order.
+// On error, the subscriptions already made are unsubscribed.
+func (r *Router) subscribeAll(conn subscriber, queue string) ([]string, []*nats.Subscription, error) {
+	subjects := r.subscribedSubjects()
+	subs := make([]*nats.Subscription, 0, len(subjects))
+	for _, subject := range subjects {
+		sub, err := subscribeTo(conn, subject, queue, r.MsgHandler())
+		if err != nil {
+			for _, s := range subs {
+				_ = s.Unsubscribe()
+			}
+
+			return nil, nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	return subjects, subs, nil
+}
+
+// resubscribe syncs the subscriptions with the routes, if the router owns
+// subscriptions: it subscribes the subjects of the routes registered or
+// enabled since Subscribe, and unsubscribes the subjects either covered by
+// a subscribed one or no longer needed, e.g. after Remove or SetEnabled.
+func (r *Router) resubscribe() {
+	r.subs.mu.Lock()
+	defer r.subs.mu.Unlock()
+
+	if r.subs.conn == nil {
+		return
+	}
+	subjects := r.subscribedSubjects()
+	for _, subject := range subjects {
+		if _, ok := r.subs.bySubject[subject]; ok {
+			continue
+		}
+		sub, err := subscribeTo(r.subs.conn, subject, r.subs.queue, r.MsgHandler())
+		if err != nil {
+			r.subscribeFailed(subject, err)
+
+			continue
+		}
+		r.subs.bySubject[subject] = sub
+	}
+
+	// Drop the subscriptions no longer needed. A subscription covered by a
+	// subject which failed to subscribe is kept, so that it still delivers.
+	wanted := make(map[string]bool, len(subjects))
+	subscribed := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		wanted[subject] = true
+		if _, ok := r.subs.bySubject[subject]; ok {
+			subscribed = append(subscribed, subject)
+		}
+	}
+	for subject, sub := range r.subs.bySubject {
+		if wanted[subject] || (coveredBy(subject, subjects) && !coveredBy(subject, subscribed)) {
+			continue
+		}
+		delete(r.subs.bySubject, subject)
+		if err := sub.Unsubscribe(); err != nil {
+			r.subscribeFailed(subject, err)
+		}
+	}
+}
+
+func (r *Router) subscribeFailed(subject string, err error) {
+	if r.SubscribeErrorHandler != nil {
+		r.SubscribeErrorHandler(subject, err)
+	}
+}
+
+// subscribedSubjects returns the subjects of the enabled routes which no
+// other one covers, i.e. the subjects to subscribe for every message to be
+// delivered once.
+func (r *Router) subscribedSubjects() []string {
+	subjects := r.subjects(true)
+	subscribed := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		if !coveredBy(subject, subjects) {
+			subscribed = append(subscribed, subject)
+		}
+	}
+
+	return subscribed
+}
+
+// coveredBy reports whether subject is covered by another one of subjects.
+func coveredBy(subject string, subjects []string) bool {
+	tokens := strings.Split(subject, ".")
+	for _, other := range subjects {
+		if other != subject && coversSubject(strings.Split(other, "."), tokens) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func subscribeTo(conn subscriber, subject, queue string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	if queue == "" {
+		return conn.Subscribe(subject, cb)
+	}
+
+	return conn.QueueSubscribe(subject, queue, cb)
+}
+
+// Unsubscribe unsubscribes all the subscriptions made by Subscribe and
+// forgets them, so that routes registered afterwards are not subscribed and
+// Subscribe can be called again, e.g. on reconfiguration. The unsubscribe
+// errors are joined, by subject.
+func (r *Router) Unsubscribe() error {
+	r.subs.mu.Lock()
+	defer r.subs.mu.Unlock()
+
+	subjects := make([]string, 0, len(r.subs.bySubject))
+	for subject := range r.subs.bySubject {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+
+	var errs []error
+	for _, subject := range subjects {
+		if err := r.subs.bySubject[subject].Unsubscribe(); err != nil {
+			errs = append(errs, fmt.Errorf("unsubscribe '%s': %w", subject, err))
+		}
+	}
+	r.subs.conn, r.subs.queue, r.subs.bySubject = nil, "", nil
+
+	return errors.Join(errs...)
+}
+
+// Healthy reports whether the router is ready to serve, e.g. for a readiness
+// probe: at least one route is registered and, if the router owns
+// subscriptions, all of them are valid and cover every subject of Subjects.
+// If not, the returned string tells why. Healthy has no side effects.
+func (r *Router) Healthy() (bool, string) {
+	if len(r.Subjects()) == 0 {
+		return false, "no routes registered"
+	}
+
+	r.subs.mu.Lock()
+	defer r.subs.mu.Unlock()
+
+	if r.subs.conn == nil {
+		return true, ""
+	}
+
+	var problems []string
+	for _, subject := range r.subscribedSubjects() {
+		sub, ok := r.subs.bySubject[subject]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("subject '%s' not subscribed", subject))
+		case !sub.IsValid():
+			problems = append(problems, fmt.Sprintf("subscription '%s' not valid", subject))
+		}
+	}
+	if len(problems) > 0 {
+		return false, strings.Join(problems, "; ")
+	}
+
+	return true, ""
+}
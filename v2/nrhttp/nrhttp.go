@@ -0,0 +1,136 @@
+// Package nrhttp exposes a natsrouter.Router over HTTP, e.g. to invoke NATS
+// routes from admin or debugging tools.
+//
+// The subject is derived from the URL path, replacing slashes with dots:
+// a request to /user/gopher/ping is routed as "user.gopher.ping".
+// Handlers receive a *Msg built from the request and can answer with
+// Msg.Respond; the response data is written back as the HTTP body.
+package nrhttp
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mondora/natsrouter/v2"
+)
+
+// DefaultTimeout is the time waited for a handler response when
+// Handler.Timeout is not set.
+const DefaultTimeout = time.Second
+
+// ErrAlreadyResponded is returned by Msg.Respond when called more than once.
+var ErrAlreadyResponded = errors.New("nrhttp: message already responded")
+
+// Msg is the natsrouter.SubjectMsg built from an HTTP request.
+// GetMsg returns the *Msg itself.
+type Msg struct {
+	Subject string
+	Data    []byte
+	Header  http.Header
+
+	reply chan []byte
+}
+
+// GetMsg returns the message itself.
+func (m *Msg) GetMsg() interface{} {
+	return m
+}
+
+// GetSubject returns the subject derived from the URL path.
+func (m *Msg) GetSubject() string {
+	return m.Subject
+}
+
+// GetData returns the request body.
+func (m *Msg) GetData() []byte {
+	return m.Data
+}
+
+// Headers returns the request headers.
+func (m *Msg) Headers() map[string][]string {
+	return m.Header
+}
+
+// GetHeader returns the first value of the given request header.
+func (m *Msg) GetHeader(key string) string {
+	return m.Header.Get(key)
+}
+
+// Respond sends data back to the HTTP client. Only the first call is
+// honored, later ones return ErrAlreadyResponded.
+func (m *Msg) Respond(data []byte) error {
+	select {
+	case m.reply <- data:
+		return nil
+	default:
+		return ErrAlreadyResponded
+	}
+}
+
+// Handler wraps a natsrouter.Router as an http.Handler.
+type Handler struct {
+	Router *natsrouter.Router
+
+	// Timeout is the time waited for the handler to call Msg.Respond.
+	// When it expires the request is answered with 202 Accepted.
+	// If zero, DefaultTimeout is used.
+	Timeout time.Duration
+}
+
+// New returns a Handler serving router over HTTP.
+func New(router *natsrouter.Router) *Handler {
+	return &Handler{Router: router}
+}
+
+// Subject converts a URL path to a NATS subject, e.g. "/user/gopher" to
+// "user.gopher".
+func Subject(path string) string {
+	return strings.ReplaceAll(strings.Trim(path, "/"), "/", ".")
+}
+
+// ServeHTTP routes the request to the handler matching its URL path.
+// It answers 404 Not Found when no route matches, the handler response
+// when one is sent in time, and 202 Accepted otherwise.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	msg := &Msg{
+		Subject: Subject(req.URL.Path),
+		Data:    data,
+		Header:  req.Header,
+		reply:   make(chan []byte, 1),
+	}
+	if err := h.Router.ServeNATS(msg); err != nil {
+		if errors.Is(err, natsrouter.ErrNotFound) {
+			http.NotFound(w, req)
+
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-msg.reply:
+		_, _ = w.Write(reply)
+	case <-timer.C:
+		w.WriteHeader(http.StatusAccepted)
+	case <-req.Context().Done():
+	}
+}
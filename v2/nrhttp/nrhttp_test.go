@@ -0,0 +1,42 @@
+package nrhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mondora/natsrouter/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubject(t *testing.T) {
+	assert.Equal(t, "user.gopher.ping", Subject("/user/gopher/ping"))
+	assert.Equal(t, "user.gopher", Subject("/user/gopher/"))
+}
+
+func TestHandler(t *testing.T) {
+	router := natsrouter.New()
+	router.Handle("user.:name.ping", 1, func(msg natsrouter.SubjectMsg, ps natsrouter.Params, _ interface{}) {
+		m := msg.GetMsg().(*Msg)
+		_ = m.Respond([]byte("pong " + ps.ByName("name") + " " + string(m.Data)))
+	})
+	router.Handle("user.:name.fire", 1, func(_ natsrouter.SubjectMsg, _ natsrouter.Params, _ interface{}) {})
+
+	handler := New(router)
+	handler.Timeout = 10 * time.Millisecond
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/user/gopher/ping", strings.NewReader("data")))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "pong gopher data", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/user/gopher/fire", nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,143 @@
+// Package nrtest provides utilities for testing natsrouter configurations:
+// a SubjectMsg double and a Recorder capturing the handlers that fired.
+package nrtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mondora/natsrouter/v2"
+	"github.com/nats-io/nats.go"
+)
+
+// Msg is a natsrouter.SubjectMsg test double, similar to a *nats.Msg.
+// GetMsg returns the *Msg itself.
+type Msg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+	Header  nats.Header
+
+	mu        sync.Mutex
+	responses [][]byte
+}
+
+// NewMessage returns a test message with the given subject and data.
+func NewMessage(subject string, data []byte) natsrouter.SubjectMsg {
+	return &Msg{
+		Subject: subject,
+		Data:    data,
+	}
+}
+
+// GetMsg returns the message itself.
+func (m *Msg) GetMsg() interface{} {
+	return m
+}
+
+// GetSubject returns the message subject.
+func (m *Msg) GetSubject() string {
+	return m.Subject
+}
+
+// GetReply returns the subject to reply to.
+func (m *Msg) GetReply() string {
+	return m.Reply
+}
+
+// GetData returns the message data.
+func (m *Msg) GetData() []byte {
+	return m.Data
+}
+
+// Headers returns the message headers.
+func (m *Msg) Headers() map[string][]string {
+	return m.Header
+}
+
+// GetHeader returns the first value of the given message header.
+func (m *Msg) GetHeader(key string) string {
+	return m.Header.Get(key)
+}
+
+// Respond records data as a response to the message.
+func (m *Msg) Respond(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses = append(m.responses, data)
+
+	return nil
+}
+
+// Responses returns the data recorded by Respond, in order.
+func (m *Msg) Responses() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([][]byte(nil), m.responses...)
+}
+
+// Call is a handler invocation captured by a Recorder.
+type Call struct {
+	// Name is the name given to Recorder.Handle.
+	Name    string
+	Subject string
+	// Params is a copy of the params the handler received.
+	Params  natsrouter.Params
+	Payload interface{}
+}
+
+// Recorder captures the invocations of the handles it builds.
+// It is safe for concurrent use.
+type Recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Handle returns a natsrouter.Handle recording its invocations under name.
+func (rec *Recorder) Handle(name string) natsrouter.Handle {
+	return func(msg natsrouter.SubjectMsg, ps natsrouter.Params, payload interface{}) {
+		var params natsrouter.Params
+		if ps != nil {
+			// Params may be pooled and reused after the handler returns
+			params = append(natsrouter.Params(nil), ps...)
+		}
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.calls = append(rec.calls, Call{
+			Name:    name,
+			Subject: msg.GetSubject(),
+			Params:  params,
+			Payload: payload,
+		})
+	}
+}
+
+// Calls returns the recorded invocations, in order.
+func (rec *Recorder) Calls() []Call {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]Call(nil), rec.calls...)
+}
+
+// Wait waits until at least n invocations have been recorded, or timeout
+// expires, and returns the recorded invocations.
+// Handlers are run asynchronously by natsrouter.Router.ServeNATS, so tests
+// should wait before checking Calls.
+func (rec *Recorder) Wait(n int, timeout time.Duration) []Call {
+	deadline := time.Now().Add(timeout)
+	for {
+		calls := rec.Calls()
+		if len(calls) >= n || time.Now().After(deadline) {
+			return calls
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,39 @@
+package nrtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mondora/natsrouter/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	router := natsrouter.New()
+	router.Handle("user.:name", 1, rec.Handle("user"))
+	router.Handle("user.:name.>", 2, rec.Handle("user-all"))
+
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("user.gopher.ping", []byte("data")), 42))
+
+	calls := rec.Wait(1, time.Second)
+	assert.Equal(t, []Call{{
+		Name:    "user-all",
+		Subject: "user.gopher.ping",
+		Params: natsrouter.Params{
+			{Key: "name", Value: "gopher"},
+			{Key: ">", Value: ".ping"},
+		},
+		Payload: 42,
+	}}, calls)
+}
+
+func TestMsg(t *testing.T) {
+	msg := NewMessage("user.gopher", []byte("data"))
+	assert.Equal(t, "user.gopher", msg.GetSubject())
+
+	m := msg.GetMsg().(*Msg)
+	assert.Equal(t, []byte("data"), m.Data)
+	assert.NoError(t, m.Respond([]byte("pong")))
+	assert.Equal(t, [][]byte{[]byte("pong")}, m.Responses())
+}
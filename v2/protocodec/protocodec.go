@@ -0,0 +1,71 @@
+// Package protocodec implements a natsrouter.Codec for Protobuf payloads,
+// keeping the protobuf dependency out of the natsrouter package.
+//
+// Register the codec on a router, then register routes with Handle to get
+// the message data unmarshaled into the route's message type:
+//
+//	protocodec.Register(router)
+//	protocodec.Handle(router, "user.:name.update", 1, &pb.User{}, handle)
+//
+// Handlers answer with Router.Respond, which marshals the response with the
+// codec of the request content type.
+package protocodec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mondora/natsrouter/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// ContentType is the content type the Codec is registered with.
+const ContentType = "application/protobuf"
+
+// ErrNotProtoMessage is returned when a value to marshal or unmarshal does
+// not implement proto.Message.
+var ErrNotProtoMessage = errors.New("protocodec: value is not a proto.Message")
+
+// Codec is a natsrouter.Codec for proto.Message values.
+type Codec struct{}
+
+// Marshal encodes v, which must be a proto.Message.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes data into v, which must be a proto.Message.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+
+	return proto.Unmarshal(data, m)
+}
+
+// Register registers the Codec on router for ContentType.
+// To decode messages without a content type header as Protobuf too, set
+// router.DefaultContentType to ContentType.
+func Register(router *natsrouter.Router) {
+	router.RegisterCodec(ContentType, Codec{})
+}
+
+// Handle registers a new request handle with the given path and rank, whose
+// payload is a new message of the type of prototype, unmarshaled from the
+// message data as with Router.HandleDecoded.
+func Handle(router *natsrouter.Router, path string, rank int, prototype proto.Message, handle natsrouter.Handle) {
+	if prototype == nil {
+		panic("prototype must not be nil")
+	}
+	msgType := prototype.ProtoReflect().Type()
+
+	router.HandleDecoded(path, rank, func() interface{} {
+		return msgType.New().Interface()
+	}, handle)
+}
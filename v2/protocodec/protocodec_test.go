@@ -0,0 +1,55 @@
+package protocodec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mondora/natsrouter/v2"
+	"github.com/mondora/natsrouter/v2/nrtest"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodec(t *testing.T) {
+	data, err := Codec{}.Marshal(wrapperspb.String("gopher"))
+	assert.NoError(t, err)
+
+	var v wrapperspb.StringValue
+	assert.NoError(t, Codec{}.Unmarshal(data, &v))
+	assert.Equal(t, "gopher", v.GetValue())
+
+	_, err = Codec{}.Marshal("gopher")
+	assert.ErrorIs(t, err, ErrNotProtoMessage)
+	assert.ErrorIs(t, Codec{}.Unmarshal(data, new(string)), ErrNotProtoMessage)
+}
+
+func TestHandle(t *testing.T) {
+	router := natsrouter.New()
+	Register(router)
+
+	done := make(chan struct{})
+	Handle(router, "user.:name.rename", 1, &wrapperspb.StringValue{}, func(msg natsrouter.SubjectMsg, ps natsrouter.Params, v interface{}) {
+		defer close(done)
+		name := v.(*wrapperspb.StringValue)
+		assert.NoError(t, router.Respond(msg, wrapperspb.String(ps.ByName("name")+" -> "+name.GetValue())))
+	})
+
+	data, err := proto.Marshal(wrapperspb.String("gordon"))
+	assert.NoError(t, err)
+	msg := &nrtest.Msg{Subject: "user.gopher.rename", Data: data, Header: nats.Header{}}
+	msg.Header.Set(natsrouter.ContentTypeHeader, ContentType)
+	assert.NoError(t, router.ServeNATS(msg))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handle not called")
+	}
+
+	var reply wrapperspb.StringValue
+	assert.Len(t, msg.Responses(), 1)
+	assert.NoError(t, proto.Unmarshal(msg.Responses()[0], &reply))
+	assert.Equal(t, "gopher -> gordon", reply.GetValue())
+}
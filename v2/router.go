@@ -1,13 +1,21 @@
 package natsrouter
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"regexp"
+	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
 )
 
 type SubjectMsg interface {
@@ -15,10 +23,77 @@ type SubjectMsg interface {
 	GetSubject() string
 }
 
+// Deadliner is an optional interface of a SubjectMsg carrying a deadline,
+// e.g. of a queued request whose requester has already given up.
+// Messages whose deadline has passed are not dispatched.
+type Deadliner interface {
+	Deadline() (deadline time.Time, ok bool)
+}
+
 // Handle is a function that can be registered to a route to handle NATS
 // requests. It has a third parameter for the values of wildcards (path variables).
 type Handle func(SubjectMsg, Params, interface{})
 
+// Handler is an object that can be registered to a route to handle NATS
+// requests, e.g. a handler carrying its own state.
+// Handle implements Handler, like http.HandlerFunc implements http.Handler.
+type Handler interface {
+	ServeNATS(SubjectMsg, Params, interface{})
+}
+
+// ServeNATS calls h(msg, ps, payload).
+func (h Handle) ServeNATS(msg SubjectMsg, ps Params, payload interface{}) {
+	h(msg, ps, payload)
+}
+
+// ErrNotFound is returned when no route matches the subject of a message.
+// See Router.NotFoundError to customize it.
+var ErrNotFound = errors.New("404 NotFound")
+
+// notFoundError is a custom Router.NotFoundError which still matches
+// ErrNotFound with errors.Is.
+type notFoundError struct {
+	err error
+}
+
+func (e *notFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notFoundError) Unwrap() []error {
+	return []error{e.err, ErrNotFound}
+}
+
+// ErrExpired is returned when the deadline of a message has already passed,
+// see Deadliner.
+var ErrExpired = errors.New("message expired")
+
+// ErrUnauthorized is returned for messages rejected by Router.Authorize.
+var ErrUnauthorized = errors.New("401 Unauthorized")
+
+// ErrNilMessage is returned by ServeNATS for a nil message, e.g. received
+// from a closed channel on shutdown.
+var ErrNilMessage = errors.New("nil message")
+
+// ErrSubjectTooLong is returned by ServeNATS for subjects longer than
+// Router.MaxSubjectLen.
+var ErrSubjectTooLong = errors.New("subject too long")
+
+// ErrNilHandler is reported when a nil handle is supplied for a route.
+var ErrNilHandler = errors.New("handle must not be nil")
+
+// ErrUnknownRank is returned by LookupStrict for a rank without routes, and
+// by ServeRank for a rank out of the range of Handle.
+var ErrUnknownRank = errors.New("unknown rank")
+
+// ErrPass can be returned by a ChainHandle to stop a sequential chain without
+// reporting an error.
+var ErrPass = errors.New("pass")
+
+// ErrNotNatsMsg is reported to Router.ErrorHandler when a handler registered
+// with HandleNats receives a message which does not wrap a *nats.Msg.
+var ErrNotNatsMsg = errors.New("message is not a *nats.Msg")
+
 // Param is a single parameter, consisting of a key and a value.
 type Param struct {
 	Key   string
@@ -30,6 +105,29 @@ type Param struct {
 // It is therefore safe to read values by the index.
 type Params []Param
 
+// NewParam returns a Param with the given key and value.
+func NewParam(key, value string) Param {
+	return Param{Key: key, Value: value}
+}
+
+// With returns a copy of ps with the given param set, replacing the value of
+// an existing param with the same key, or appending it otherwise.
+// ps itself is left untouched, so it is safe to use on params owned by the
+// router, e.g. in middleware injecting synthetic params like auth claims.
+func (ps Params) With(key, value string) Params {
+	with := make(Params, len(ps), len(ps)+1)
+	copy(with, ps)
+	for i := range with {
+		if with[i].Key == key {
+			with[i].Value = value
+
+			return with
+		}
+	}
+
+	return append(with, NewParam(key, value))
+}
+
 // ByName returns the value of the first Param which key matches the given name.
 // If no matching Param is found, an empty string is returned.
 func (ps Params) ByName(name string) string {
@@ -42,6 +140,109 @@ func (ps Params) ByName(name string) string {
 	return ""
 }
 
+// String returns the params as a comma separated "key=value" list, e.g.
+// "name=gopher, region=eu", for logging. Internal params added by the
+// router, like MatchedRoutePathParam, are left out; see StringAll.
+func (ps Params) String() string {
+	return ps.format(false)
+}
+
+// StringAll works like String, but also includes internal params.
+func (ps Params) StringAll() string {
+	return ps.format(true)
+}
+
+func (ps Params) format(all bool) string {
+	var sb strings.Builder
+	for _, p := range ps {
+		if !all && isInternalParam(p.Key) {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(p.Key)
+		sb.WriteByte('=')
+		sb.WriteString(p.Value)
+	}
+
+	return sb.String()
+}
+
+// UserParams returns the params captured from wildcards, without the internal
+// params added by the router, like MatchedRoutePathParam. It makes equality
+// checks and decoding independent of Router.SaveMatchedRoutePath. If there is
+// nothing to filter, ps itself is returned.
+func (ps Params) UserParams() Params {
+	n := 0
+	for _, p := range ps {
+		if !isInternalParam(p.Key) {
+			n++
+		}
+	}
+	if n == len(ps) {
+		return ps
+	}
+
+	user := make(Params, 0, n)
+	for _, p := range ps {
+		if !isInternalParam(p.Key) {
+			user = append(user, p)
+		}
+	}
+
+	return user
+}
+
+// isInternalParam reports whether key names a param added by the router
+// rather than captured from a wildcard.
+func isInternalParam(key string) bool {
+	return strings.HasPrefix(key, "$")
+}
+
+// Len returns the number of params.
+func (ps Params) Len() int {
+	return len(ps)
+}
+
+// First returns the first Param, i.e. the first wildcard of the subject.
+// If there are no params, it returns false.
+func (ps Params) First() (Param, bool) {
+	if len(ps) == 0 {
+		return Param{}, false
+	}
+
+	return ps[0], true
+}
+
+// Last returns the last Param, e.g. the catch-all value of a route ending
+// with '>'. If there are no params, it returns false.
+func (ps Params) Last() (Param, bool) {
+	if len(ps) == 0 {
+		return Param{}, false
+	}
+
+	return ps[len(ps)-1], true
+}
+
+// SortedByKey returns a copy of ps sorted by key, e.g. to compare or log
+// params independently of the order of the wildcards in the route.
+// Params with the same key keep their relative order. ps itself is left
+// untouched, as indexed access relies on its order.
+func (ps Params) SortedByKey() Params {
+	if ps == nil {
+		return nil
+	}
+
+	sorted := make(Params, len(ps))
+	copy(sorted, ps)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Key < sorted[j].Key
+	})
+
+	return sorted
+}
+
 var (
 	reNATSPathCatchAll = regexp.MustCompile(`(.*)\.>$`)
 	reNATSPathToken    = regexp.MustCompile(`(\.\*)`)
@@ -51,18 +252,91 @@ const subsNATSPath = "$1.*>"
 
 func fromNatsPath(path string) string {
 	i := 0
-	path = reNATSPathToken.ReplaceAllStringFunc(path, func(string) string {
+	// Prefix a '.' so that a leading '*' token is rewritten as well
+	path = reNATSPathToken.ReplaceAllStringFunc("."+path, func(string) string {
 		i++
 
 		return fmt.Sprintf(".:p%d", i)
-	})
+	})[1:]
 	result := reNATSPathCatchAll.ReplaceAllString(path, subsNATSPath)
 
 	return result
 }
 
+// routerPath converts a pattern to router notation, see fromNatsPath.
+// If EnablePlusToken is set, '+' tokens become ':+pN' wildcards, numbered
+// along with the '*' ones.
+func (r *Router) routerPath(pattern string) string {
+	if !r.EnablePlusToken {
+		return fromNatsPath(pattern)
+	}
+
+	tokens := Split(pattern)
+	var plus []int
+	for i, token := range tokens {
+		if token == "+" {
+			tokens[i] = "*"
+			plus = append(plus, i)
+		}
+	}
+	if len(plus) == 0 {
+		return fromNatsPath(pattern)
+	}
+
+	tokens = Split(fromNatsPath(strings.Join(tokens, ".")))
+	for _, i := range plus {
+		tokens[i] = ":+" + tokens[i][1:]
+	}
+
+	return strings.Join(tokens, ".")
+}
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+	// Pattern is the path as passed to Handle, e.g. "user.*.>".
+	Pattern string
+	// Path is the pattern in router notation, e.g. "user.:p1.*>".
+	Path string
+	Rank int
+}
+
+// matchPath returns the path an incoming subject is matched as, after
+// Rewrite and NormalizeSubject.
+func (r *Router) matchPath(subject string) string {
+	if r.Rewrite != nil {
+		subject = r.Rewrite(subject)
+	}
+	if r.NormalizeSubject {
+		subject = normalizeSubject(subject)
+	}
+
+	return subject
+}
+
+// normalizeSubject collapses consecutive '.' separators and trims leading
+// and trailing ones. Well-formed subjects are returned without allocating.
+func normalizeSubject(subject string) string {
+	if !strings.Contains(subject, "..") &&
+		!strings.HasPrefix(subject, ".") && !strings.HasSuffix(subject, ".") {
+		return subject
+	}
+
+	tokens := strings.Split(subject, ".")
+	n := 0
+	for _, token := range tokens {
+		if token != "" {
+			tokens[n] = token
+			n++
+		}
+	}
+
+	return strings.Join(tokens[:n], ".")
+}
+
 // MatchedRoutePathParam is the Param name under which the path of the matched
 // route is stored, if Router.SaveMatchedRoutePath is set.
+// Param names starting with '$' are reserved for the router: wildcards can
+// not be named so. Subjects starting with '$', like "$SYS.>", are fine.
 var MatchedRoutePathParam = "$matchedRoutePath" //nolint
 
 // MatchedRoutePath retrieves the path of the matched route.
@@ -72,24 +346,151 @@ func (ps Params) MatchedRoutePath() string {
 	return ps.ByName(MatchedRoutePathParam)
 }
 
+// CorrelationIDParam is the Param name under which the correlation id of the
+// message is stored, if Router.CorrelationID is set.
+var CorrelationIDParam = "$correlationID" //nolint
+
+// CorrelationID retrieves the correlation id of the message.
+// Router.CorrelationID must have been set, otherwise this function always
+// returns an empty string.
+func (ps Params) CorrelationID() string {
+	return ps.ByName(CorrelationIDParam)
+}
+
 // Router is a handler which can be used to dispatch requests to different
 // handler functions via configurable routes
 type Router struct {
+	// guards the routing table against Swap and other changes.
+	// Matching only takes the read lock, so concurrent serving does not
+	// serialize, see BenchmarkConcurrentServe. An atomically swapped
+	// immutable snapshot would spare the reader count updates, but the
+	// table is also changed in place, e.g. by SetEnabled.
+	mu sync.RWMutex
+
 	trees map[int]*node
 	// rank map start from priority 1 to max 255
 
 	paramsPool sync.Pool
 	maxParams  uint16
 
+	// params pool counters, see ParamsPoolStats
+	paramsGets   atomic.Uint64
+	paramsMisses atomic.Uint64
+
 	// If enabled, adds the matched route path onto the request context
 	// before invoking the handler.
 	// The matched route path is only added to handlers of routes that were
 	// registered when this option was enabled.
 	SaveMatchedRoutePath bool
 
-	// Cached value of global (*) allowed ranks
+	// If enabled, the leading '.' is stripped from the value captured by a
+	// catch-all wildcard, e.g. "user.>" matching "user.gopher.ok" yields
+	// "gopher.ok" instead of ".gopher.ok".
+	// The leading '.' is kept by default for compatibility with existing
+	// consumers of ps.ByName(">").
+	TrimCatchAllDot bool
+
+	// If enabled, the tokens of the value captured by a catch-all wildcard
+	// are also appended as indexed params, e.g. "user.>" matching
+	// "user.star.ok" adds ">0" = "star" and ">1" = "ok" after ">".
+	SplitCatchAll bool
+
+	// If enabled, the tokens of the value captured by a catch-all wildcard
+	// are also appended as params numbered after the '*' ones, as if each
+	// was matched by a '*', e.g. "user.*.>" matching "user.gopher.star.ok"
+	// adds "p2" = "star" and "p3" = "ok" after "p1" and ">".
+	// It takes the place of SplitCatchAll if both are set, so that each
+	// token is recorded once.
+	NumberCatchAll bool
+
+	// If enabled, fresh Params are allocated for every match instead of
+	// being taken from (and returned to) the internal pool.
+	// Useful in debug and test builds to rule out retention of pooled
+	// Params beyond the lifetime of a handler call.
+	DisableParamsPool bool
+
+	// If enabled, consecutive '.' separators in the subject of an incoming
+	// message are collapsed and leading/trailing ones trimmed before
+	// matching, e.g. "a..b." is matched as "a.b".
+	// This diverges from strict NATS semantics, where "a..b" holds an empty
+	// token, and is meant for integrations with sloppy publishers.
+	NormalizeSubject bool
+
+	// If enabled, a '+' token in a pattern matches one or more tokens, as
+	// few as possible up to the rest of the pattern, e.g. "files.+.meta"
+	// matches "files.a.b.meta". The consumed tokens are captured as a param
+	// named like a '*' one, e.g. "p1". This is a non-standard extension:
+	// NATS has no such wildcard, and routes using it are subscribed with a
+	// trailing '>' from the '+' on. '+' is a literal token otherwise.
+	EnablePlusToken bool
+
+	// Function rewriting the subject of an incoming message before matching,
+	// e.g. to map legacy subject schemes onto the current routes during a
+	// migration. Handlers still get the original subject from the message.
+	Rewrite func(subject string) string
+
+	// Function extracting the subject to route a message on, e.g. from a
+	// header or a payload field, instead of its GetSubject. The extracted
+	// subject then goes through MaxSubjectLen, Rewrite and the other checks
+	// as usual, while handlers still get the message unchanged.
+	// If nil, GetSubject is used.
+	SubjectFunc func(msg SubjectMsg) string
+
+	// If enabled, Handle rejects patterns which are not valid NATS subjects,
+	// e.g. holding spaces, control characters, empty tokens or wildcards
+	// mixed with other characters, by panicking with a precise message.
+	// HandleE returns the message as an error instead.
+	Strict bool
+
+	// If enabled, Handle fails fast by panicking (HandleE by returning an
+	// error) when a pattern matching the same subjects is already registered
+	// at another rank, since only the lowest rank would ever be dispatched.
+	WarnOnRankShadow bool
+
+	// Maximum length in bytes of the subjects served. Longer subjects are
+	// rejected with ErrSubjectTooLong before any matching, to guard against
+	// untrusted publishers. If zero, subjects are not limited.
+	MaxSubjectLen int
+
+	// If enabled, the subjects served are checked before any matching, and
+	// rejected with ErrInvalidSubject if empty or holding empty tokens,
+	// wildcards, whitespace or control characters, e.g. to tell malformed
+	// publisher input from subjects matching no route. The subject is
+	// checked as matched, i.e. after Rewrite and NormalizeSubject.
+	ValidateIncoming bool
+
+	// If positive, the matches of up to this many recently served subjects
+	// are cached, bypassing the tree traversal for a hot set of subjects.
+	// The cache is dropped on any routing table change.
+	// It must be set before serving messages.
+	LookupCacheSize int
+
+	// If enabled, the patterns and paths of the routes are interned, so that
+	// a route registered at several ranks, or registered again after Remove,
+	// stores its pattern and path once, and the tokens of the trees, which
+	// are substrings of the interned paths, share their storage too.
+	// It reduces the memory footprint of large routing tables registering
+	// the same patterns at several ranks, at the cost of a lookup per
+	// registration. The strings are released with the last route using them.
+	// It must be set before registering routes.
+	InternTokens bool
+
+	// Function ordering the handles run by ServeNATSAll, reporting whether
+	// the route a runs before b, e.g. by a priority of their patterns.
+	// If nil, the handles run in rank order.
+	HandlerOrder func(a, b RouteMeta) bool
+
+	// Content type of messages without a ContentTypeHeader, selecting the
+	// Codec used by Decode and Respond. If empty, ContentTypeJSON is used.
+	DefaultContentType string
+
+	// Cached value of global (*) allowed ranks, updated along with the rank
+	// list by addRank and removeRank
 	globalAllowed string
 
+	// registered routes, in registration order
+	routes []RouteInfo
+
 	// sorted rank list
 	rankIndexList []int
 	initialized   bool
@@ -98,6 +499,145 @@ type Router struct {
 	// The handler can be used to keep your server from crashing because of
 	// unrecovered panics.
 	PanicHandler func(SubjectMsg, interface{})
+
+	// Like PanicHandler, but also receives the stack trace captured when
+	// the panic was recovered. If both are set, only this one is called.
+	PanicHandlerWithStack func(SubjectMsg, interface{}, []byte)
+
+	// Function to handle errors raised while adapting a message for a
+	// typed handler, e.g. a HandleNats handler receiving a message which
+	// does not wrap a *nats.Msg.
+	// If nil, such messages are silently dropped.
+	ErrorHandler func(SubjectMsg, error)
+
+	// Function building the reply sent to request-reply messages which
+	// match no route, so that requesters do not wait for a timeout.
+	// The message, or the value returned by its GetMsg, must implement
+	// Responder; see NatsMsg.
+	NotFoundReply func(SubjectMsg) []byte
+
+	// Function called with the result of a route registered with HandleEmit
+	// and the subject of its message, when the message has no reply subject.
+	// It derives the output subject from the input one, and publishes the
+	// result there, see NatsResultPublisher.
+	ResultPublisher func(inSubject string, result []byte)
+
+	// Function called for messages which match no route, e.g. to dead-letter
+	// them. It receives the payload given to ServeNATSWithPayload, if any.
+	// ServeNATS still returns ErrNotFound.
+	NotFoundHandler func(SubjectMsg, interface{})
+	// If enabled, NotFoundHandler runs in a new goroutine, like the handles,
+	// instead of inline, so that a slow handler, e.g. publishing to a dead
+	// letter subject, does not block the caller of ServeNATS.
+	NotFoundAsync bool
+
+	// Error returned instead of ErrNotFound for messages which match no
+	// route, e.g. to map it onto an application error taxonomy.
+	// The returned error wraps both NotFoundError and ErrNotFound, so that
+	// errors.Is(err, ErrNotFound) still holds.
+	NotFoundError error
+
+	// Function called when a handler runs longer than SlowThreshold, with
+	// the pattern, as passed to Handle, and rank of its route and the
+	// measured wall-clock duration. Both inline and asynchronous handlers
+	// are timed.
+	OnSlow        func(pattern string, rank int, d time.Duration)
+	SlowThreshold time.Duration
+	// Like OnSlow, with the correlation id of the message, see CorrelationID.
+	OnSlowCorrelated func(pattern string, rank int, d time.Duration, correlationID string)
+
+	// Function extracting the correlation id of messages, e.g. from a token
+	// of their subject or a header, or returning "" if they carry none.
+	// The id is added to the params of the handles, see
+	// Params.CorrelationID, so that it is surfaced without parsing it again
+	// in every handler. Hooks receiving the message, like ErrorHandler, get
+	// it with Router.CorrelationIDOf, and OnSlowCorrelated along with the
+	// slow route.
+	// It should be set before registering routes, so that the params have
+	// room for the id.
+	CorrelationID func(SubjectMsg) string
+
+	// Function called instead of dispatching messages whose deadline has
+	// already passed, see Deadliner. ServeNATS returns ErrExpired for them.
+	ExpiredHandler func(SubjectMsg, interface{})
+
+	// Function returning the expiry of a message from the params of its
+	// route, e.g. parsed from an issued-at token of the subject, or false if
+	// it has none. Messages matching a route after their expiry are handed
+	// to the ExpiredHandler instead of dispatched, and ServeNATS returns
+	// ErrExpired for them. ServeNATSAll skips the expired routes only.
+	ExpiryFromParams func(Params) (time.Time, bool)
+
+	// Function called before matching each message, e.g. to reject subjects
+	// a tenant is not allowed to publish to. Messages for which it returns
+	// false are not dispatched: they are handed to UnauthorizedHandler, if
+	// set, and ServeNATS returns ErrUnauthorized.
+	Authorize           func(subject string, msg SubjectMsg) bool
+	UnauthorizedHandler func(SubjectMsg, interface{})
+
+	// If set, asynchronous handlers are run by a fixed set of worker
+	// goroutines instead of a new goroutine per message. Messages with the
+	// same key are always run by the same worker, hence in order, while
+	// messages with different keys are processed in parallel.
+	OrderingKey func(SubjectMsg) string
+
+	// Function called after the routing table changed, e.g. by Handle,
+	// SetEnabled or Swap, so that subscriptions can be recomputed.
+	// It is called without holding any router lock.
+	OnChange func()
+
+	// Function called after each route is added, by Handle or any of its
+	// variants, with the pattern as passed to it and the rank, e.g. to log
+	// or audit the routes registered at startup, in order. It is called
+	// before OnChange, without holding any router lock.
+	OnRegister func(pattern string, rank int)
+
+	// Function called when a subject needed by a route registered after
+	// Subscribe cannot be subscribed. The route is registered anyway, but
+	// receives no messages until subscribed otherwise.
+	SubscribeErrorHandler func(subject string, err error)
+
+	// Executor running the handles dispatched asynchronously, i.e. neither
+	// inline nor on the workers of OrderingKey, and NotFoundHandler if
+	// NotFoundAsync is set. If nil, each one runs in a new goroutine.
+	// The concurrent handles of HandleMulti keep their own goroutines, since
+	// their route waits for them, which could deadlock a bounded executor.
+	Executor Executor
+
+	// Number of workers used with OrderingKey.
+	// If zero, runtime.NumCPU() is used. It must be set before serving.
+	Workers int
+
+	workers     []chan func()
+	workersOnce sync.Once
+
+	// Codecs registered with RegisterCodec, by media type
+	codecs map[string]Codec
+
+	lookupCache     *lookupCache
+	lookupCacheOnce sync.Once
+
+	// Registration ids of the routes, see Register
+	registrations map[routeKey]uint64
+
+	// Subscriptions owned by the router, see Subscribe
+	subs subscriptions
+
+	// Handles by payload type of the routes registered with HandleTyped
+	typed map[routeKey]*typedRoute
+
+	// Interned patterns and paths, see InternTokens
+	interned interner
+}
+
+// registrationIDs generates the registration ids of all routers, so that
+// they stay unique across Swap.
+var registrationIDs atomic.Uint64
+
+// routeKey identifies a route by its path in router notation and its rank.
+type routeKey struct {
+	path string
+	rank int
 }
 
 // New returns a new initialized Router.
@@ -110,7 +650,23 @@ func New() *Router {
 }
 
 func (r *Router) getParams() *Params {
+	if r.DisableParamsPool {
+		if r.maxParams == 0 {
+			return nil
+		}
+		ps := make(Params, 0, r.maxParams)
+
+		return &ps
+	}
 	if ps, ok := r.paramsPool.Get().(*Params); ok {
+		r.paramsGets.Add(1)
+		if cap(*ps) < int(r.maxParams) {
+			// Pooled before maxParams grew, e.g. by Swap
+			r.paramsMisses.Add(1)
+			fresh := make(Params, 0, r.maxParams)
+
+			return &fresh
+		}
 		*ps = (*ps)[0:0] // reset slice
 
 		return ps
@@ -120,19 +676,44 @@ func (r *Router) getParams() *Params {
 }
 
 func (r *Router) putParams(ps *Params) {
-	if ps != nil {
+	if ps != nil && !r.DisableParamsPool {
 		r.paramsPool.Put(ps)
 	}
 }
 
+// PoolStats reports the sizing and usage of the router Params pool.
+type PoolStats struct {
+	// MaxParams is the capacity of the pooled Params, i.e. the highest
+	// number of params of any registered route.
+	MaxParams uint16
+	// Gets is the number of Params taken from the pool.
+	Gets uint64
+	// Misses is the number of Gets which had to allocate new Params
+	// because the pool was empty.
+	Misses uint64
+}
+
+// ParamsPoolStats returns the sizing and usage counters of the Params pool.
+// A Misses count close to Gets means the pool is not being reused.
+func (r *Router) ParamsPoolStats() PoolStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return PoolStats{
+		MaxParams: r.maxParams,
+		Gets:      r.paramsGets.Load(),
+		Misses:    r.paramsMisses.Load(),
+	}
+}
+
 func (r *Router) saveMatchedRoutePath(path string, handle Handle) Handle {
+	// Routes without params share a preallocated slice instead of taking one
+	// from the pool. Its capacity is capped, so that appending copies it.
+	static := Params{{Key: MatchedRoutePathParam, Value: path}}
+
 	return func(msg SubjectMsg, ps Params, payload interface{}) {
 		if ps == nil {
-			psp := r.getParams()
-			ps := (*psp)[0:1]
-			ps[0] = Param{Key: MatchedRoutePathParam, Value: path}
-			handle(msg, ps, payload)
-			r.putParams(psp)
+			handle(msg, static[:1:1], payload)
 		} else {
 			ps = append(ps, Param{Key: MatchedRoutePathParam, Value: path})
 			handle(msg, ps, payload)
@@ -141,21 +722,103 @@ func (r *Router) saveMatchedRoutePath(path string, handle Handle) Handle {
 }
 
 // Handle registers a new request handle with the given path.
+// It panics if the path conflicts with a route already registered with the
+// rank: past their common leading tokens, a '*' or '>' wildcard cannot stand
+// where the other route has any other token, i.e. a literal one, another
+// kind of wildcard or a differently named one. So "a.b.c", "a.>" and "a.:id"
+// all conflict with "a.*", even when they match different subjects, while
+// "a.*.c" and "a.*.d" do not. Hence a subject matches at most one route per
+// rank; conflicting patterns go on different ranks, where the lowest
+// matching one wins.
 func (r *Router) Handle(path string, rank int, handle Handle) {
-	varsCount := uint16(0)
+	r.handle(path, rank, handle, routeOptions{})
+}
+
+// routeOptions are the per-route settings of a route, set along with it so
+// that it is never served without them.
+type routeOptions struct {
+	inline  bool
+	sem     chan struct{}
+	payload interface{}
+}
 
+// handle registers a route, see Handle, and returns its registration id.
+func (r *Router) handle(path string, rank int, handle Handle, opts routeOptions) uint64 {
 	if rank <= 0 || rank > 255 {
 		panic("rank must be > 0")
 	}
+
+	return r.register(path, rank, handle, opts)
+}
+
+// HandleFallback registers a new request handle with the given path, matched
+// only by the messages missing the routes of every rank, before the
+// NotFoundHandler: a message matching a fallback route is dispatched to it
+// and is not reported as not found. The routes are kept apart from the ranks,
+// and reported with FallbackRank, e.g. by Routes.
+func (r *Router) HandleFallback(path string, handle Handle) {
+	r.register(path, FallbackRank, handle, routeOptions{})
+}
+
+// FallbackRank is the rank of the routes registered with HandleFallback.
+const FallbackRank = 0
+
+// register registers a route with a valid rank, see handle.
+func (r *Router) register(path string, rank int, handle Handle, opts routeOptions) uint64 {
 	if handle == nil {
 		panic("handle must not be nil")
 	}
-	path = fromNatsPath(path)
+	if r.Strict {
+		if err := validatePattern(path); err != nil {
+			panic(err.Error())
+		}
+	}
+	pattern := path
+	path = r.routerPath(path)
+	for _, token := range Split(path) {
+		if !r.EnablePlusToken && strings.HasPrefix(token, ":+") {
+			panic("wildcard '" + token + "' requires EnablePlusToken in path '" + path + "'")
+		}
+		if len(token) > 1 && (token[0] == ':' || token[0] == '*') && isInternalParam(token[1:]) {
+			panic("wildcard name '" + token + "' uses the reserved '$' prefix in path '" + path + "'")
+		}
+	}
+
+	id := r.addRoute(pattern, path, rank, handle, opts)
+	if r.OnRegister != nil {
+		r.OnRegister(pattern, rank)
+	}
+	r.changed()
+
+	return id
+}
+
+// addRoute adds the route to the tree of its rank, under lock.
+// It returns the id of the registration.
+func (r *Router) addRoute(pattern, path string, rank int, handle Handle, opts routeOptions) uint64 {
+	varsCount := uint16(0)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pattern, path = r.intern(pattern), r.intern(path)
+	added := false
+	defer func() {
+		// A route failing to register keeps no interned strings
+		if !added {
+			r.release(RouteInfo{Pattern: pattern, Path: path})
+		}
+	}()
+
+	r.checkRankShadow(pattern, path, rank, routeKey{})
 
 	if r.SaveMatchedRoutePath {
 		varsCount++
 		handle = r.saveMatchedRoutePath(path, handle)
 	}
+	if r.CorrelationID != nil {
+		varsCount++
+	}
 
 	if r.trees == nil {
 		r.trees = make(map[int]*node)
@@ -163,22 +826,72 @@ func (r *Router) Handle(path string, rank int, handle Handle) {
 
 	root := r.trees[rank]
 	if root == nil {
+		// Only add the rank once the route is added, since it may panic
 		root = new(node)
+		root.addRoute(path, handle, &root)
+		if rank != FallbackRank {
+			r.addRank(rank)
+		}
 		r.trees[rank] = root
-
-		r.globalAllowed = r.allowed("*", 0)
+	} else {
+		// Kept even on panic, since the root may be split before a conflict
+		defer func() { r.trees[rank] = root }()
+		root.addRoute(path, handle, &root)
 	}
-
-	root.addRoute(path, handle)
+	leaf := findLeaf(root, path)
+	leaf.pattern = pattern
+	leaf.inline, leaf.sem, leaf.payload = opts.inline, opts.sem, opts.payload
+	r.invalidateLookupCache()
+	r.routes = append(r.routes, RouteInfo{Pattern: pattern, Path: path, Rank: rank})
+	if r.registrations == nil {
+		r.registrations = make(map[routeKey]uint64)
+	}
+	id := registrationIDs.Add(1)
+	r.registrations[routeKey{path, rank}] = id
 
 	// Update maxParams
 	if paramsCount := countParams(path); paramsCount+varsCount > r.maxParams {
 		r.maxParams = paramsCount + varsCount
 	}
 
-	// Lazy-init paramsPool alloc func
+	r.initParamsPool()
+	added = true
+
+	return id
+}
+
+// checkRankShadow panics, if WarnOnRankShadow is set, when a route with the
+// given path on rank would have the subject of a route on another rank,
+// except the route of skip, e.g. the one being moved. The caller must hold
+// r.mu.
+func (r *Router) checkRankShadow(pattern, path string, rank int, skip routeKey) {
+	if !r.WarnOnRankShadow || rank == FallbackRank {
+		return
+	}
+
+	subject := toNatsSubject(path)
+	for _, route := range r.routes {
+		if route.Rank != rank && route.Rank != FallbackRank && (routeKey{route.Path, route.Rank}) != skip &&
+			toNatsSubject(route.Path) == subject {
+			panic(fmt.Sprintf("path '%s' on rank %d shadows or is shadowed by '%s' on rank %d",
+				pattern, rank, route.Pattern, route.Rank))
+		}
+	}
+}
+
+// changed notifies OnChange of a routing table change.
+func (r *Router) changed() {
+	r.resubscribe()
+	if r.OnChange != nil {
+		r.OnChange()
+	}
+}
+
+// initParamsPool lazily inits the paramsPool alloc func.
+func (r *Router) initParamsPool() {
 	if r.paramsPool.New == nil && r.maxParams > 0 {
 		r.paramsPool.New = func() interface{} {
+			r.paramsMisses.Add(1)
 			ps := make(Params, 0, r.maxParams)
 
 			return &ps
@@ -186,155 +899,1795 @@ func (r *Router) Handle(path string, rank int, handle Handle) {
 	}
 }
 
-// Lookup allows the manual lookup of a rank + path combo.
-// This is e.g. useful to build a framework around this router.
-// If the path was found, it returns the handle function and the path parameter
-// values.
-func (r *Router) Lookup(path string, rank int) (Handle, Params, bool) {
+// HandleInline registers a new request handle with the given path, which is
+// run synchronously by ServeNATS instead of in a new goroutine.
+// It is meant for cheap handlers, and keeps the order of their messages.
+func (r *Router) HandleInline(path string, rank int, handle Handle) {
+	r.handle(path, rank, handle, routeOptions{inline: true})
+}
+
+// HandleWithConcurrency registers a new request handle with the given path
+// and rank, of which at most limit calls run at the same time. Further
+// messages wait for a running call to complete, e.g. to protect a downstream
+// service with a connection cap without throttling the other routes.
+func (r *Router) HandleWithConcurrency(path string, rank int, limit int, handle Handle) {
+	if limit <= 0 {
+		panic("concurrency limit must be > 0")
+	}
+	r.handle(path, rank, handle, routeOptions{sem: make(chan struct{}, limit)})
+}
+
+// HandleWithDefaultPayload registers a new request handle with the given path
+// and rank, which receives payload when served without one, e.g. by
+// ServeNATS. This binds static dependencies to a route without threading
+// them through ServeNATSWithPayload.
+func (r *Router) HandleWithDefaultPayload(path string, rank int, payload interface{}, handle Handle) {
+	r.handle(path, rank, handle, routeOptions{payload: payload})
+}
+
+// findNode returns the tree node registered with the given path (in router
+// notation) and rank, or nil. The caller must hold r.mu.
+func (r *Router) findNode(path string, rank int) *node {
 	if root := r.trees[rank]; root != nil {
-		handle, ps, tsr := root.getValue(path, r.getParams)
-		if handle == nil {
-			r.putParams(ps)
+		return findLeaf(root, path)
+	}
 
-			return nil, nil, tsr
-		}
-		if ps == nil {
-			return handle, nil, tsr
-		}
+	return nil
+}
 
-		return handle, *ps, tsr
+// findLeaf returns the node of the tree registered with the given path, or nil.
+func findLeaf(root *node, path string) *node {
+	if _, _, leaf, _ := root.getValue(path, nil, false); leaf != nil && leaf.fullPath == path {
+		return leaf
 	}
 
-	return nil, nil, false
+	return nil
 }
 
-func (r *Router) allowed(path string, reqRank int) (allow string) {
-	allowed := make([]int, 0, 9)
+// ChainHandle is a handle of a route registered with HandleMulti.
+// Errors other than ErrPass are reported to the ErrorHandler.
+type ChainHandle func(SubjectMsg, Params, interface{}) error
 
-	if path == "*" { // server-wide
-		// 0 rank is used for internal calls to refresh the cache
-		if reqRank == 0 {
-			for rank := range r.trees {
-				// Add request rank to list of allowed ranks
-				allowed = append(allowed, rank)
-			}
-		} else {
-			return r.globalAllowed
-		}
-	} else { // specific path
-		for rank := range r.trees {
-			// Skip the requested rank - we already tried this one
-			if rank == reqRank {
-				continue
-			}
+// MultiOptions configures how the handles of a HandleMulti route are run.
+type MultiOptions struct {
+	// If enabled, the handles are run one after the other, in the order
+	// they were given. A handle returning ErrPass stops the chain.
+	// Otherwise all handles are run concurrently.
+	Sequential bool
 
-			handle, _, _ := r.trees[rank].getValue(path, nil)
-			if handle != nil {
-				// Add request rank to list of allowed ranks
-				allowed = append(allowed, rank)
-			}
+	// If enabled, a sequential chain also stops at the first handle
+	// returning any other non-nil error.
+	StopOnError bool
+}
+
+// HandleMulti registers several handles with the same path and rank, run
+// concurrently or as a sequential pipeline according to opts.
+// The route completes once all handles have returned.
+func (r *Router) HandleMulti(path string, rank int, opts MultiOptions, handles ...ChainHandle) {
+	if len(handles) == 0 {
+		panic("handles must not be empty")
+	}
+	for _, handle := range handles {
+		if handle == nil {
+			panic("handle must not be nil")
 		}
 	}
 
-	if len(allowed) > 0 {
-		// Sort allowed ranks.
-		// sort.Strings(allowed) unfortunately causes unnecessary allocations
-		// due to allowed being moved to the heap and interface conversion
-		for i, l := 1, len(allowed); i < l; i++ {
-			for j := i; j > 0 && allowed[j] < allowed[j-1]; j-- {
-				allowed[j], allowed[j-1] = allowed[j-1], allowed[j]
-			}
+	report := func(msg SubjectMsg, err error) {
+		if err != nil && !errors.Is(err, ErrPass) && r.ErrorHandler != nil {
+			r.ErrorHandler(msg, err)
 		}
+	}
 
-		// return as comma separated list
-		allowedStr := []string{}
-		for i := range allowed {
-			prio := allowed[i]
-			ptxt := strconv.Itoa(prio)
-			allowedStr = append(allowedStr, ptxt)
-		}
+	if opts.Sequential {
+		r.Handle(path, rank, func(msg SubjectMsg, ps Params, payload interface{}) {
+			for _, handle := range handles {
+				err := handle(msg, ps, payload)
+				report(msg, err)
+				if errors.Is(err, ErrPass) || (err != nil && opts.StopOnError) {
+					return
+				}
+			}
+		})
 
-		return strings.Join(allowedStr, ", ")
+		return
 	}
 
-	return ""
+	r.Handle(path, rank, func(msg SubjectMsg, ps Params, payload interface{}) {
+		var wg sync.WaitGroup
+		wg.Add(len(handles))
+		for _, handle := range handles {
+			go func(handle ChainHandle) {
+				defer wg.Done()
+				report(msg, handle(msg, ps, payload))
+			}(handle)
+		}
+		// Params are returned to the pool once the route completes
+		wg.Wait()
+	})
 }
 
-func (r *Router) recv(msg SubjectMsg) {
-	if rcv := recover(); rcv != nil {
-		r.PanicHandler(msg, rcv)
+// HandleObject registers a new request Handler with the given path.
+func (r *Router) HandleObject(path string, rank int, handler Handler) {
+	if handler == nil {
+		panic("handler must not be nil")
 	}
+	r.Handle(path, rank, handler.ServeNATS)
 }
 
-func (r *Router) getRankList() []int {
-	if !r.initialized {
-		for rank := range r.trees {
-			r.rankIndexList = append(r.rankIndexList, rank)
-		}
+// HandleE works like Handle, but returns an error instead of panicking on an
+// invalid registration, e.g. for routes loaded from configuration.
+// A nil handle is reported as ErrNilHandler.
+func (r *Router) HandleE(path string, rank int, handle Handle) (err error) {
+	if handle == nil {
+		return ErrNilHandler
+	}
+
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("%v", rcv)
+		}
+	}()
+	r.Handle(path, rank, handle)
+
+	return nil
+}
+
+// HandleNats registers a new request handle with the given path, receiving
+// the *nats.Msg wrapped by the SubjectMsg instead of the SubjectMsg itself.
+// Messages whose GetMsg does not return a *nats.Msg are reported to the
+// ErrorHandler with ErrNotNatsMsg.
+func (r *Router) HandleNats(path string, rank int, handle func(*nats.Msg, Params, interface{})) {
+	r.Handle(path, rank, r.FromNatsHandle(handle))
+}
+
+// FromNatsHandle adapts a handler written for the v1 router, which receives
+// the *nats.Msg itself, to a Handle, so that it can be registered with any
+// of the Handle methods while migrating to ranks.
+// Messages whose GetMsg does not return a *nats.Msg are reported to the
+// ErrorHandler with ErrNotNatsMsg.
+func (r *Router) FromNatsHandle(handle func(*nats.Msg, Params, interface{})) Handle {
+	if handle == nil {
+		panic("handle must not be nil")
+	}
+
+	return func(msg SubjectMsg, ps Params, payload interface{}) {
+		natsMsg, ok := msg.GetMsg().(*nats.Msg)
+		if !ok {
+			if r.ErrorHandler != nil {
+				r.ErrorHandler(msg, fmt.Errorf("%w: got %T", ErrNotNatsMsg, msg.GetMsg()))
+			}
+
+			return
+		}
+		handle(natsMsg, ps, payload)
+	}
+}
+
+// HandleFactory registers a route whose handle is built by factory on the
+// first matching message and then cached, e.g. for handlers opening
+// connections that should not be set up for routes that never fire.
+// The factory runs once, even under concurrent dispatch. If it panics, the
+// panic is handled like a panic of the handle, e.g. by the PanicHandler, and
+// the next matching message runs the factory again. If it returns nil,
+// matching messages are reported to the ErrorHandler with ErrNilHandler.
+func (r *Router) HandleFactory(path string, rank int, factory func() Handle) {
+	if factory == nil {
+		panic("factory must not be nil")
+	}
+
+	var (
+		mu     sync.Mutex
+		built  atomic.Bool
+		handle Handle
+	)
+	build := func() {
+		mu.Lock()
+		// Unlocked on panic too, leaving the route to build again
+		defer mu.Unlock()
+		if !built.Load() {
+			handle = factory()
+			built.Store(true)
+		}
+	}
+	r.Handle(path, rank, func(msg SubjectMsg, ps Params, payload interface{}) {
+		if !built.Load() {
+			build()
+		}
+		if handle == nil {
+			if r.ErrorHandler != nil {
+				r.ErrorHandler(msg, ErrNilHandler)
+			}
+
+			return
+		}
+		handle(msg, ps, payload)
+	})
+}
+
+// MatchInfo is the result of LookupInfo.
+type MatchInfo struct {
+	Handle Handle
+	Params Params
+	// Pattern of the matched route, as passed to Handle.
+	Pattern string
+	// Path of the matched route, in router notation.
+	Path string
+	Rank int
+	// TSR is true on a miss by a trailing '.' only, see LookupTSR.
+	TSR bool
+}
+
+// LookupInfo works like Lookup, but bundles everything known about the match
+// in a single tree traversal, e.g. for proxies built on the router.
+// On a miss it returns false along with the TSR flag and the rank.
+func (r *Router) LookupInfo(subject string, rank int) (*MatchInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info := &MatchInfo{Rank: rank}
+	root := r.trees[rank]
+	if root == nil {
+		return info, false
+	}
+
+	handle, ps, leaf, tsr := root.getValue(subject, r.getParams, r.TrimCatchAllDot)
+	if handle == nil {
+		r.putParams(ps)
+		info.TSR = tsr
+
+		return info, false
+	}
+	if ps != nil {
+		if r.splitsCatchAll(leaf) {
+			r.splitCatchAll(ps)
+		}
+		info.Params = *ps
+	}
+	info.Handle = handle
+	info.Path = leaf.fullPath
+	info.Pattern = r.patternOf(leaf.fullPath, rank)
+
+	return info, true
+}
+
+// Lookup allows the manual lookup of a rank + path combo.
+// This is e.g. useful to build a framework around this router.
+// If the path was found, it returns the handle function and the path parameter
+// values.
+func (r *Router) Lookup(path string, rank int) (Handle, Params, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if root := r.trees[rank]; root != nil {
+		handle, ps, leaf, tsr := root.getValue(path, r.getParams, r.TrimCatchAllDot)
+		if handle == nil {
+			r.putParams(ps)
+
+			return nil, nil, tsr
+		}
+		if ps == nil {
+			return handle, nil, tsr
+		}
+		if r.splitsCatchAll(leaf) {
+			r.splitCatchAll(ps)
+		}
+
+		return handle, *ps, tsr
+	}
+
+	return nil, nil, false
+}
+
+// Extract matches subject against the routes of the given rank, as ServeRank
+// would, and returns the captured params without running any handle, e.g.
+// to parse a subject into fields with the patterns of the router.
+// The params are a copy, which the caller may keep, unlike the ones returned
+// by Lookup. They are nil if the matched route has no params.
+func (r *Router) Extract(subject string, rank int) (Params, bool) {
+	path := r.matchPath(subject)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handle, ps, _ := r.matchTree(path, rank)
+	if handle == nil {
+		return nil, false
+	}
+	if ps == nil {
+		return nil, true
+	}
+	params := make(Params, len(*ps))
+	copy(params, *ps)
+	r.putParams(ps)
+
+	return params, true
+}
+
+// LookupStrict works like Lookup, but returns ErrUnknownRank if no route is
+// registered with the given rank, so that a mistyped rank is told apart from
+// a path matching no route of the rank.
+func (r *Router) LookupStrict(path string, rank int) (Handle, Params, bool, error) {
+	r.mu.RLock()
+	_, known := r.trees[rank]
+	r.mu.RUnlock()
+	if !known {
+		return nil, nil, false, fmt.Errorf("%w %d", ErrUnknownRank, rank)
+	}
+	handle, ps, tsr := r.Lookup(path, rank)
+
+	return handle, ps, tsr, nil
+}
+
+// LookupTSR reports whether subject misses the routes of the given rank only
+// by a trailing '.' separator, e.g. "user.gopher." while "user.gopher" is
+// registered, or the other way around. Nothing is dispatched.
+func (r *Router) LookupTSR(subject string, rank int) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	root := r.trees[rank]
+	if root == nil {
+		return false
+	}
+	_, _, _, tsr := root.getValue(subject, nil, false)
+
+	return tsr
+}
+
+// Routes returns the registered routes sorted by rank and path.
+func (r *Router) Routes() []RouteInfo {
+	routes := r.RoutesInOrder()
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Rank != routes[j].Rank {
+			return routes[i].Rank < routes[j].Rank
+		}
+
+		return routes[i].Path < routes[j].Path
+	})
+
+	return routes
+}
+
+// RoutesInOrder returns the registered routes in registration order, e.g.
+// to replay a configuration.
+func (r *Router) RoutesInOrder() []RouteInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	routes := make([]RouteInfo, len(r.routes))
+	copy(routes, r.routes)
+
+	return routes
+}
+
+// UnreachableRoutes returns the routes which can never be dispatched to,
+// because every subject they match is already matched by a route of a
+// lower (hence served first) rank, e.g. "ROUTING.v2.FEEDBACK.>" on rank 2
+// shadowed by "ROUTING.v2.>" on rank 1. Fallback routes are served last,
+// so they never shadow a rank but may be shadowed by any.
+// It is meant to catch misconfigurations at boot.
+func (r *Router) UnreachableRoutes() []RouteInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var unreachable []RouteInfo
+	for _, route := range r.routes {
+		subject := strings.Split(toNatsSubject(route.Path), ".")
+		for _, other := range r.routes {
+			if other.Rank == FallbackRank || (route.Rank != FallbackRank && other.Rank >= route.Rank) {
+				continue
+			}
+			if coversSubject(strings.Split(toNatsSubject(other.Path), "."), subject) {
+				unreachable = append(unreachable, route)
+
+				break
+			}
+		}
+	}
+
+	return unreachable
+}
+
+// coversSubject reports whether every subject matched by the tokens of
+// pattern b is also matched by the tokens of pattern a.
+func coversSubject(a, b []string) bool {
+	for i, token := range a {
+		if token == ">" {
+			return len(b) > i
+		}
+		if i >= len(b) || b[i] == ">" {
+			return false
+		}
+		if token != "*" && token != b[i] {
+			return false
+		}
+	}
+
+	return len(a) == len(b)
+}
+
+// SetEnabled enables or disables the route registered with the given pattern
+// and rank, as passed to Handle. A disabled route is kept in the tree but
+// does not match: messages fall through to the next ranks, or are not found.
+// It returns false if no such route exists.
+func (r *Router) SetEnabled(pattern string, rank int, enabled bool) bool {
+	r.mu.Lock()
+	n := r.findNode(r.routerPath(pattern), rank)
+	if n == nil || n.handle == nil {
+		r.mu.Unlock()
+
+		return false
+	}
+	n.disabled = !enabled
+	r.invalidateLookupCache()
+	r.mu.Unlock()
+
+	r.changed()
+
+	return true
+}
+
+// Rerank moves the route registered with the given pattern, as passed to
+// Handle, from one rank to another, e.g. to adjust priorities at runtime.
+// The move is atomic: messages are matched either against the route at the
+// old rank or at the new one. It returns false if no such route exists.
+// Like Handle, it panics if the route conflicts with a route of the new rank,
+// or, if WarnOnRankShadow is set, shadows or is shadowed by another rank.
+func (r *Router) Rerank(pattern string, from, to int) bool {
+	if to <= 0 || to > 255 {
+		panic("rank must be > 0")
+	}
+	ok, moved := r.rerank(r.routerPath(pattern), from, to)
+	if moved {
+		r.changed()
+	}
+
+	return ok
+}
+
+// rerank moves the route under lock, see Rerank. It reports whether the
+// route exists and whether it was moved.
+func (r *Router) rerank(path string, from, to int) (ok, moved bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.findNode(path, from)
+	if n == nil || n.handle == nil {
+		return false, false
+	}
+	if from == to {
+		return true, false
+	}
+	r.checkRankShadow(n.pattern, path, to, routeKey{path, from})
+
+	// Build both trees aside, so that a conflict leaves the routes untouched
+	toRoot := r.rebuildTree(to, "")
+	toRoot.addRoute(path, n.handle, &toRoot)
+	leaf := findLeaf(toRoot, path)
+	leaf.copyFlags(n)
+	fromRoot := r.rebuildTree(from, path)
+
+	routes := make([]RouteInfo, 0, len(r.routes))
+	fromUsed := false
+	for _, route := range r.routes {
+		if route.Rank == from && route.Path == path {
+			route.Rank = to
+		} else if route.Rank == from {
+			fromUsed = true
+		}
+		routes = append(routes, route)
+	}
+	r.routes = routes
+	if id, ok := r.registrations[routeKey{path, from}]; ok {
+		delete(r.registrations, routeKey{path, from})
+		r.registrations[routeKey{path, to}] = id
+	}
+	if route, ok := r.typed[routeKey{path, from}]; ok {
+		delete(r.typed, routeKey{path, from})
+		r.typed[routeKey{path, to}] = route
+	}
+
+	if _, ok := r.trees[to]; !ok {
+		r.addRank(to)
+	}
+	r.trees[to] = toRoot
+	if fromUsed {
+		r.trees[from] = fromRoot
+	} else {
+		delete(r.trees, from)
+		r.removeRank(from)
+	}
+	r.invalidateLookupCache()
+
+	return true, true
+}
+
+// Remove removes the route registered with the given pattern and rank, as
+// passed to Handle. It returns false if no such route exists.
+func (r *Router) Remove(pattern string, rank int) bool {
+	removed := r.remove(r.routerPath(pattern), rank)
+	if removed {
+		r.changed()
+	}
+
+	return removed
+}
+
+// remove removes a route under lock, see Remove.
+func (r *Router) remove(path string, rank int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.removeRoute(routeKey{path, rank})
+}
+
+// unregister removes the route of the given registration, wherever it was
+// moved by Rerank. The caller must not hold r.mu.
+func (r *Router) unregister(id uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, registered := range r.registrations {
+		if registered == id {
+			return r.removeRoute(key)
+		}
+	}
+
+	return false
+}
+
+// removeRoute removes a route. The caller must hold r.mu.
+func (r *Router) removeRoute(key routeKey) bool {
+	path, rank := key.path, key.rank
+	if n := r.findNode(path, rank); n == nil || n.handle == nil {
+		return false
+	}
+
+	routes := make([]RouteInfo, 0, len(r.routes))
+	used := false
+	for _, route := range r.routes {
+		if route.Rank == rank && route.Path == path {
+			r.release(route)
+
+			continue
+		}
+		used = used || route.Rank == rank
+		routes = append(routes, route)
+	}
+
+	if used {
+		r.trees[rank] = r.rebuildTree(rank, path)
+	} else {
+		delete(r.trees, rank)
+		r.removeRank(rank)
+	}
+	r.routes = routes
+	delete(r.registrations, key)
+	delete(r.typed, key)
+	r.invalidateLookupCache()
+
+	return true
+}
+
+// Register works like HandleE, but also returns a function removing exactly
+// this registration, e.g. to tear down temporary routes in plugins or tests.
+// Calling unregister again, or after the route was replaced, does nothing.
+func (r *Router) Register(path string, rank int, handle Handle) (unregister func(), err error) {
+	if handle == nil {
+		return nil, ErrNilHandler
+	}
+
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("%v", rcv)
+		}
+	}()
+	id := r.handle(path, rank, handle, routeOptions{})
+
+	return func() {
+		if r.unregister(id) {
+			r.changed()
+		}
+	}, nil
+}
+
+// rebuildTree returns a copy of the tree of the given rank, without the route
+// with the given path. The caller must hold r.mu.
+func (r *Router) rebuildTree(rank int, skip string) *node {
+	root := new(node)
+	for _, route := range r.routes {
+		if route.Rank != rank || route.Path == skip {
+			continue
+		}
+		n := r.findNode(route.Path, rank)
+		root.addRoute(route.Path, n.handle, &root)
+		copied := findLeaf(root, route.Path)
+		copied.copyFlags(n)
+	}
+
+	return root
+}
+
+// RouteMeta describes a registered route, as reported by Walk and Inspect.
+type RouteMeta struct {
+	// Pattern of the route, as passed to Handle.
+	Pattern string
+	// Path of the route, in router notation.
+	Path string
+	Rank int
+	// CatchAll is true if the route ends with a '>' catch-all.
+	CatchAll bool
+	// Params lists the names of the params of the route, in order, e.g.
+	// ["p1", ">"] for "user.*.>".
+	Params []string
+	// Enabled is false if the route was disabled with SetEnabled.
+	Enabled bool
+	// Inline is true if the route was registered with HandleInline.
+	Inline bool
+	// ConcurrencyLimit is the limit set with HandleWithConcurrency, or zero.
+	ConcurrencyLimit int
+}
+
+// Walk calls fn with the metadata of every registered route, in rank order,
+// until fn returns false. The routing table is read-locked meanwhile, so fn
+// must not modify the router.
+func (r *Router) Walk(fn func(RouteMeta) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rank := range r.rankList() {
+		completed := r.trees[rank].walk(func(n *node) bool {
+			if n.handle == nil {
+				return true
+			}
+
+			return fn(r.routeMeta(n, rank))
+		})
+		if !completed {
+			return
+		}
+	}
+}
+
+// routeMeta returns the metadata of the route of a leaf node.
+// The caller must hold r.mu.
+func (r *Router) routeMeta(n *node, rank int) RouteMeta {
+	return RouteMeta{
+		Pattern:          r.patternOf(n.fullPath, rank),
+		Path:             n.fullPath,
+		Rank:             rank,
+		CatchAll:         n.nType == catchAll,
+		Params:           paramNames(n.fullPath),
+		Enabled:          !n.disabled,
+		Inline:           n.inline,
+		ConcurrencyLimit: cap(n.sem),
+	}
+}
+
+// TreeStat describes the shape of the tree of a rank, as reported by
+// TreeStats.
+type TreeStat struct {
+	// Nodes is the number of nodes of the tree, including the root.
+	Nodes int
+	// MaxDepth is the number of nodes on the longest path from the root.
+	MaxDepth int
+	// MaxFanOut is the largest number of children of a node.
+	MaxFanOut int
+	// Wildcards is the number of '*' (and '+') wildcard nodes.
+	Wildcards int
+	// CatchAlls is the number of '>' catch-all nodes.
+	CatchAlls int
+}
+
+// TreeStats returns the shape of the tree of each rank, e.g. for capacity
+// planning of large routing tables or to spot pathological fan-out. The
+// fallback tree, if any, is reported on FallbackRank. Each tree is walked
+// once, with the routing table read-locked.
+func (r *Router) TreeStats() map[int]TreeStat {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	stats := make(map[int]TreeStat, len(r.trees))
+	for rank, root := range r.trees {
+		var st TreeStat
+		root.stats(1, &st)
+		stats[rank] = st
+	}
+
+	return stats
+}
+
+// HitCounts returns how many times the handle of each route was dispatched,
+// by pattern as passed to Handle, e.g. to find the routes which are never
+// used: those are listed with a zero count. The counts of a pattern
+// registered on several ranks are summed.
+func (r *Router) HitCounts() map[string]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[string]uint64, len(r.routes))
+	for _, route := range r.routes {
+		if n := r.findNode(route.Path, route.Rank); n != nil {
+			counts[route.Pattern] += n.hits.Load()
+		}
+	}
+
+	return counts
+}
+
+// ResetHitCounts sets the counts returned by HitCounts back to zero.
+func (r *Router) ResetHitCounts() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rank := range r.rankList() {
+		r.trees[rank].walk(func(n *node) bool {
+			n.hits.Store(0)
+
+			return true
+		})
+	}
+}
+
+// Inspect returns the metadata of every registered route, in rank order,
+// e.g. as a snapshot of the routing configuration for admin dashboards.
+func (r *Router) Inspect() []RouteMeta {
+	var routes []RouteMeta
+	r.Walk(func(meta RouteMeta) bool {
+		routes = append(routes, meta)
+
+		return true
+	})
+
+	return routes
+}
+
+// paramNames returns the names of the params of a path in router notation.
+func paramNames(path string) []string {
+	var names []string
+	for _, token := range Split(path) {
+		if len(token) > 1 && (token[0] == ':' || token[0] == '*') {
+			names = append(names, strings.TrimPrefix(token[1:], "+"))
+		}
+	}
+
+	return names
+}
+
+// ParamNames returns the names of the params a pattern declares, in order,
+// as its handles find them in Params: "p1", "p2", ... for '*' tokens, custom
+// names for ':name' tokens and ">" for a trailing '>', e.g. "p1", "id" and
+// ">" for "user.*.:id.>". It is nil if the pattern has no wildcards.
+// '+' tokens are literals here, as on a Router without EnablePlusToken.
+func ParamNames(pattern string) []string {
+	return paramNames(fromNatsPath(pattern))
+}
+
+// LookupPattern returns the handle registered with the given pattern and
+// rank, as passed to Handle (e.g. "user.*.>"), without matching it against
+// other routes like Lookup does.
+// This is e.g. useful for tooling inspecting or replacing a specific route.
+func (r *Router) LookupPattern(pattern string, rank int) (Handle, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n := r.findNode(r.routerPath(pattern), rank); n != nil && n.handle != nil {
+		return n.handle, true
+	}
+
+	return nil, false
+}
+
+func (r *Router) allowed(path string, reqRank int) (allow string) {
+	if path == "*" {
+		return r.globalAllowed
+	}
+
+	// Most routers have few ranks, so the list fits on the stack
+	var ranks [9]int
+
+	return joinRanks(r.allowedRanks(path, reqRank, ranks[:0]))
+}
+
+// joinRanks returns the ranks as a comma separated list, e.g. "1, 2".
+// A single rank below 100 is returned without allocating.
+func joinRanks(ranks []int) string {
+	switch len(ranks) {
+	case 0:
+		return ""
+	case 1:
+		return strconv.Itoa(ranks[0])
+	}
+
+	// Most lists fit on the stack, so that only the result is allocated
+	var stack [64]byte
+	buf := stack[:0]
+	for i, rank := range ranks {
+		if i > 0 {
+			buf = append(buf, ", "...)
+		}
+		buf = strconv.AppendInt(buf, int64(rank), 10)
+	}
+
+	return string(buf)
+}
+
+// allowedRanks appends to allowed the ranks, but reqRank, with a route for
+// path, or all ranks if path is "*". The caller must hold r.mu.
+func (r *Router) allowedRanks(path string, reqRank int, allowed []int) []int {
+	if path == "*" { // server-wide
+		// The rank list is already sorted
+		return append(allowed, r.rankList()...)
+	}
+
+	// specific path
+	for _, rank := range r.rankList() {
+		// Skip the requested rank - we already tried this one
+		if rank == reqRank {
+			continue
+		}
+
+		handle, _, _, _ := r.trees[rank].getValue(path, nil, false)
+		if handle != nil {
+			// Add request rank to list of allowed ranks
+			allowed = append(allowed, rank)
+		}
+	}
+
+	return allowed
+}
+
+// AllowedRanks returns, in order, the ranks with routes for query, which is
+// one of:
+//   - "*", for all the ranks with routes;
+//   - a subject, for the ranks with a route matching it exactly, i.e. the
+//     ranks ServeRank would dispatch it at;
+//   - a pattern with '*' or '>' tokens, for the ranks with any route under
+//     it, i.e. whose subjects match the pattern, or start with tokens
+//     matching it: "ROUTING.v2.*" is answered by routes like
+//     "ROUTING.v2.users" and "ROUTING.v2.*.get", but not "ROUTING.v1.>".
+//
+// Unlike a subject query, a pattern query inspects all the routes of the
+// ranks, so it is meant for tooling rather than serving.
+func (r *Router) AllowedRanks(query string) []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if query == "*" || !strings.ContainsAny(query, "*>") {
+		return r.allowedRanks(query, 0, nil)
+	}
+
+	tokens := Split(query)
+	allowed := make([]int, 0, 9)
+	for _, rank := range r.rankList() {
+		found := !r.trees[rank].walk(func(n *node) bool {
+			return n.handle == nil || n.disabled || !routeUnder(Split(toNatsSubject(n.fullPath)), tokens)
+		})
+		if found {
+			allowed = append(allowed, rank)
+		}
+	}
+
+	return allowed
+}
+
+// routeUnder reports whether a route, given by the tokens of its NATS
+// pattern, has subjects matching the query pattern or starting with tokens
+// matching it.
+func routeUnder(route, query []string) bool {
+	for i, q := range query {
+		if i >= len(route) {
+			return false
+		}
+		if q == ">" || route[i] == ">" {
+			return true
+		}
+		if q != "*" && route[i] != "*" && q != route[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Router) recv(msg SubjectMsg) {
+	if rcv := recover(); rcv != nil {
+		if r.PanicHandlerWithStack != nil {
+			r.PanicHandlerWithStack(msg, rcv, debug.Stack())
+
+			return
+		}
+		r.PanicHandler(msg, rcv)
+	}
+}
+
+// recovers reports whether panics are recovered and handed to a handler.
+func (r *Router) recovers() bool {
+	return r.PanicHandler != nil || r.PanicHandlerWithStack != nil
+}
+
+// addRank inserts a new rank into the sorted rank list.
+func (r *Router) addRank(rank int) {
+	rankList := r.getRankList()
+	i := sort.SearchInts(rankList, rank)
+
+	// Copy, so that a rank list being iterated is left untouched
+	ranks := make([]int, 0, len(rankList)+1)
+	ranks = append(ranks, rankList[:i]...)
+	ranks = append(ranks, rank)
+	r.rankIndexList = append(ranks, rankList[i:]...)
+	r.globalAllowed = joinRanks(r.rankIndexList)
+}
+
+// removeRank removes a rank from the sorted rank list.
+func (r *Router) removeRank(rank int) {
+	rankList := r.getRankList()
+	i := sort.SearchInts(rankList, rank)
+	if i == len(rankList) || rankList[i] != rank {
+		return
+	}
+
+	// Copy, so that a rank list being iterated is left untouched
+	ranks := make([]int, 0, len(rankList)-1)
+	ranks = append(ranks, rankList[:i]...)
+	r.rankIndexList = append(ranks, rankList[i+1:]...)
+	r.globalAllowed = joinRanks(r.rankIndexList)
+}
+
+// getRankList returns the sorted rank list, building it from the trees on
+// first use. The caller must hold r.mu for writing; readers use rankList.
+func (r *Router) getRankList() []int {
+	if !r.initialized {
+		for rank := range r.trees {
+			// The fallback tree is consulted apart, after every rank
+			if rank != FallbackRank {
+				r.rankIndexList = append(r.rankIndexList, rank)
+			}
+		}
 		sort.Ints(r.rankIndexList)
 		r.initialized = true
 	}
 
-	return r.rankIndexList
+	return r.rankIndexList
+}
+
+// rankList returns the sorted rank list like getRankList, but without
+// building it, so that it is safe under the read lock. The list is built by
+// the first registration: until then, it is computed aside.
+func (r *Router) rankList() []int {
+	if r.initialized || (len(r.trees) == 0 && len(r.rankIndexList) == 0) {
+		return r.rankIndexList
+	}
+
+	ranks := append([]int(nil), r.rankIndexList...)
+	for rank := range r.trees {
+		if rank != FallbackRank {
+			ranks = append(ranks, rank)
+		}
+	}
+	sort.Ints(ranks)
+
+	return ranks
 }
 
-// ServeNATS makes the router implement interface.
-func (r *Router) ServeNATS(msg SubjectMsg) error {
-	if r.PanicHandler != nil {
+// Swap atomically replaces the routes of r with the routes of other, e.g. to
+// hot-reload a routing table built from scratch. Messages being matched
+// complete against the old routes, later ones use the new routes.
+// The options and hooks of r, like PanicHandler, are kept.
+// The routing table of other is copied, so that changes to either router
+// afterwards leave the other one untouched. Only the handles by type of the
+// routes registered with HandleTyped stay shared.
+func (r *Router) Swap(other *Router) {
+	other.mu.RLock()
+	trees := make(map[int]*node, len(other.trees))
+	for rank := range other.trees {
+		trees[rank] = other.rebuildTree(rank, "")
+	}
+	routes := append([]RouteInfo(nil), other.routes...)
+	rankList := append([]int(nil), other.rankList()...)
+	globalAllowed, maxParams := other.globalAllowed, other.maxParams
+	registrations := make(map[routeKey]uint64, len(other.registrations))
+	for key, id := range other.registrations {
+		registrations[key] = id
+	}
+	typed := make(map[routeKey]*typedRoute, len(other.typed))
+	for key, route := range other.typed {
+		typed[key] = route
+	}
+	other.mu.RUnlock()
+
+	defer r.changed()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trees = trees
+	// Intern the routes of other afresh, so that Remove releases them
+	r.interned = nil
+	for i := range routes {
+		routes[i].Pattern, routes[i].Path = r.intern(routes[i].Pattern), r.intern(routes[i].Path)
+	}
+	r.routes = routes
+	r.registrations = registrations
+	r.typed = typed
+	r.rankIndexList = rankList
+	r.initialized = true
+	r.globalAllowed = globalAllowed
+	r.maxParams = maxParams
+	r.initParamsPool()
+	r.invalidateLookupCache()
+}
+
+// Ranks returns the sorted list of ranks with registered routes.
+// The returned slice is a copy and can be modified by the caller.
+func (r *Router) Ranks() []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rankList := r.rankList()
+	ranks := make([]int, len(rankList))
+	copy(ranks, rankList)
+
+	return ranks
+}
+
+// call runs a matched handle and returns its params to the pool.
+// If the handle panics, its params are discarded instead, since they may
+// still be referenced, and the panic is handed to the PanicHandler if set.
+// If OnSlow is set, handles running longer than SlowThreshold are reported.
+func (r *Router) call(handle Handle, msg SubjectMsg, ps *Params, payload interface{}, leaf *node, rank int) {
+	leaf.hits.Add(1)
+	if r.recovers() {
 		defer r.recv(msg)
 	}
+	if sem := leaf.sem; sem != nil {
+		sem <- struct{}{}
+		defer func() { <-sem }()
+	}
+	var correlationID string
+	if r.CorrelationID != nil {
+		correlationID = r.CorrelationID(msg)
+	}
+	pattern := leaf.pattern
+	if (r.OnSlow != nil || r.OnSlowCorrelated != nil) && r.SlowThreshold > 0 {
+		start := time.Now()
+		defer func() {
+			if d := time.Since(start); d > r.SlowThreshold {
+				if r.OnSlow != nil {
+					r.OnSlow(pattern, rank, d)
+				}
+				if r.OnSlowCorrelated != nil {
+					r.OnSlowCorrelated(pattern, rank, d, correlationID)
+				}
+			}
+		}()
+	}
 
-	path := msg.GetSubject()
+	switch {
+	case ps != nil:
+		if correlationID != "" {
+			*ps = append(*ps, Param{Key: CorrelationIDParam, Value: correlationID})
+		}
+		handle(msg, *ps, payload)
+		// Not reached on panic
+		r.putParams(ps)
+	case correlationID != "":
+		handle(msg, Params{{Key: CorrelationIDParam, Value: correlationID}}, payload)
+	default:
+		handle(msg, nil, payload)
+	}
+}
 
-	rankList := r.getRankList()
-	for _, rank := range rankList {
-		if root := r.trees[rank]; root != nil {
-			if handle, ps, _ := root.getValue(path, r.getParams); handle != nil {
-				if ps != nil {
-					go func() {
-						handle(msg, *ps, nil)
-						r.putParams(ps)
-					}()
-				} else {
-					go func() {
-						handle(msg, nil, nil)
-					}()
+// CorrelationIDOf returns the correlation id of msg extracted by
+// CorrelationID, or "" if it is not set.
+func (r *Router) CorrelationIDOf(msg SubjectMsg) string {
+	if r.CorrelationID == nil {
+		return ""
+	}
+
+	return r.CorrelationID(msg)
+}
+
+// Executor runs the functions dispatched asynchronously by a Router, e.g. on a
+// bounded goroutine pool. Go must not block the caller for long, since it
+// runs on the serving path.
+type Executor interface {
+	Go(task func())
+}
+
+// ExecutorFunc adapts a function to the Executor interface.
+type ExecutorFunc func(task func())
+
+// Go calls f(task).
+func (f ExecutorFunc) Go(task func()) {
+	f(task)
+}
+
+// GoExecutor runs each task in a new goroutine, as a Router without Executor.
+var GoExecutor Executor = ExecutorFunc(func(task func()) { go task() })
+
+// InlineExecutor runs each task in the calling goroutine, so that ServeNATS
+// returns once the handle completes, e.g. for deterministic tests.
+var InlineExecutor Executor = ExecutorFunc(func(task func()) { task() })
+
+// BoundedExecutor runs the tasks with exec, or each in a new goroutine if
+// nil, but at most n at a time across the router, e.g. to cap the handles
+// running concurrently. Tasks over the limit wait for a slot in their own
+// goroutine, so Go does not block the caller unless exec does.
+func BoundedExecutor(exec Executor, n int) Executor {
+	if n <= 0 {
+		panic("limit must be > 0")
+	}
+	if exec == nil {
+		exec = GoExecutor
+	}
+	sem := make(chan struct{}, n)
+
+	return ExecutorFunc(func(task func()) {
+		exec.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			task()
+		})
+	})
+}
+
+// goExec runs task with the Executor, or in a new goroutine.
+func (r *Router) goExec(task func()) {
+	if r.Executor != nil {
+		r.Executor.Go(task)
+	} else {
+		go task()
+	}
+}
+
+// worker returns the queue of the worker running the messages with the given
+// ordering key, starting the workers on first use.
+func (r *Router) worker(key string) chan<- func() {
+	r.workersOnce.Do(func() {
+		n := r.Workers
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		r.workers = make([]chan func(), n)
+		for i := range r.workers {
+			queue := make(chan func(), 64)
+			r.workers[i] = queue
+			go func() {
+				for run := range queue {
+					run()
 				}
+			}()
+		}
+	})
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	return r.workers[h.Sum32()%uint32(len(r.workers))]
+}
+
+// MatchResult is the route a subject is dispatched to, as reported by DryRun.
+type MatchResult struct {
+	// Pattern of the matched route, as passed to Handle.
+	Pattern string
+	// Path of the matched route, in router notation.
+	Path   string
+	Rank   int
+	Params Params
+	// Found is false if no route matches the subject.
+	Found bool
+}
+
+// match returns the handle, params and leaf node of the first rank matching
+// path, or a nil handle.
+func (r *Router) match(path string) (handle Handle, ps *Params, leaf *node, rank int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	cache := r.getLookupCache()
+	if cache != nil {
+		if entry, ok := cache.get(path); ok {
+			if entry.params != nil {
+				ps = r.getParams()
+				*ps = append(*ps, entry.params...)
+			}
+
+			return entry.handle, ps, entry.leaf, entry.rank
+		}
+	}
+
+	rankList := r.rankList()
+	for _, rank = range rankList {
+		if handle, ps, leaf = r.matchTree(path, rank); handle != nil {
+			break
+		}
+	}
+	if handle == nil {
+		rank = FallbackRank
+		if handle, ps, leaf = r.matchTree(path, rank); handle == nil {
+			return nil, nil, nil, 0
+		}
+	}
 
-				return nil
+	if cache != nil {
+		entry := &lookupEntry{path: path, handle: handle, leaf: leaf, rank: rank}
+		if ps != nil {
+			entry.params = append(Params(nil), *ps...)
+		}
+		cache.add(entry)
+	}
+
+	return handle, ps, leaf, rank
+}
+
+// matchTree returns the handle, params and leaf node of the route of the
+// given rank matching path, or a nil handle. The caller must hold r.mu.
+func (r *Router) matchTree(path string, rank int) (Handle, *Params, *node) {
+	root := r.trees[rank]
+	if root == nil {
+		return nil, nil, nil
+	}
+
+	handle, ps, leaf, _ := root.getValue(path, r.getParams, r.TrimCatchAllDot)
+	if handle == nil {
+		// e.g. a disabled route
+		r.putParams(ps)
+
+		return nil, nil, nil
+	}
+	if r.splitsCatchAll(leaf) && ps != nil {
+		r.splitCatchAll(ps)
+	}
+
+	return handle, ps, leaf
+}
+
+// splitsCatchAll reports whether the catch-all value of a leaf is split into
+// tokens, see SplitCatchAll and NumberCatchAll.
+func (r *Router) splitsCatchAll(leaf *node) bool {
+	return (r.SplitCatchAll || r.NumberCatchAll) && leaf.nType == catchAll
+}
+
+// splitCatchAll appends the tokens of the last (catch-all) param as params,
+// named after its key and index, or numbered after the '*' params if
+// NumberCatchAll is set.
+func (r *Router) splitCatchAll(ps *Params) {
+	last := (*ps)[len(*ps)-1]
+	key := func(i int) string { return last.Key + strconv.Itoa(i) }
+	if r.NumberCatchAll {
+		next := 1
+		for _, p := range (*ps)[:len(*ps)-1] {
+			if n, ok := wildcardIndex(p.Key); ok && n >= next {
+				next = n + 1
 			}
 		}
+		key = func(i int) string { return "p" + strconv.Itoa(next+i) }
+	}
+
+	value := strings.TrimPrefix(last.Value, ".")
+	for i := 0; ; i++ {
+		end := strings.IndexByte(value, '.')
+		if end < 0 {
+			*ps = append(*ps, Param{Key: key(i), Value: value})
+
+			return
+		}
+		*ps = append(*ps, Param{Key: key(i), Value: value[:end]})
+		value = value[end+1:]
 	}
-	// Handle 404
-	return errors.New("404 NotFound")
 }
 
-func (r *Router) ServeNATSWithPayload(msg SubjectMsg, payload interface{}) error {
-	if r.PanicHandler != nil {
+// wildcardIndex returns N for the name "pN" of a '*' param.
+func wildcardIndex(key string) (int, bool) {
+	if len(key) < 2 || key[0] != 'p' || key[1] < '1' || key[1] > '9' {
+		return 0, false
+	}
+	n, err := strconv.Atoi(key[1:])
+
+	return n, err == nil
+}
+
+// DryRun matches each subject against the routes like ServeNATS, without
+// invoking any handler, e.g. to check in CI that representative subjects
+// are routed as expected.
+func (r *Router) DryRun(subjects []string) map[string]MatchResult {
+	results := make(map[string]MatchResult, len(subjects))
+	for _, subject := range subjects {
+		path := r.matchPath(subject)
+
+		var result MatchResult
+		if handle, ps, leaf, rank := r.match(path); handle != nil {
+			result = MatchResult{Pattern: leaf.pattern, Path: leaf.fullPath, Rank: rank, Found: true}
+			if ps != nil {
+				result.Params = append(Params(nil), *ps...)
+			}
+			r.putParams(ps)
+		}
+		results[subject] = result
+	}
+
+	return results
+}
+
+// LoadReport is the match distribution measured by SimulateLoad.
+type LoadReport struct {
+	// Hits counts the matches of each route.
+	Hits map[RouteInfo]int
+	// Misses counts the subjects matching no route.
+	Misses int
+	// Total is the number of subjects matched.
+	Total int
+	// AvgLatency is the average time spent matching a subject.
+	AvgLatency time.Duration
+}
+
+// SimulateLoad matches the subjects n times like ServeNATS, without invoking
+// any handler, and reports how often each route matched and how long
+// matching took. It helps finding hot paths before deploying a routing table.
+func (r *Router) SimulateLoad(subjects []string, n int) LoadReport {
+	type route struct {
+		path string
+		rank int
+	}
+	hits := make(map[route]int)
+	report := LoadReport{Hits: make(map[RouteInfo]int)}
+
+	var elapsed time.Duration
+	for i := 0; i < n; i++ {
+		for _, subject := range subjects {
+			start := time.Now()
+			path := r.matchPath(subject)
+			handle, ps, leaf, rank := r.match(path)
+			elapsed += time.Since(start)
+
+			if handle == nil {
+				report.Misses++
+			} else {
+				hits[route{leaf.fullPath, rank}]++
+				r.putParams(ps)
+			}
+			report.Total++
+		}
+	}
+	if report.Total > 0 {
+		report.AvgLatency = elapsed / time.Duration(report.Total)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for key, count := range hits {
+		report.Hits[RouteInfo{Pattern: r.patternOf(key.path, key.rank), Path: key.path, Rank: key.rank}] = count
+	}
+
+	return report
+}
+
+// Match is a route matching a subject, as returned by MatchAll.
+type Match struct {
+	// Pattern of the route, as passed to Handle.
+	Pattern string
+	Rank    int
+	Handle  Handle
+	// Params is owned by the caller: it is not shared with the pool.
+	Params Params
+}
+
+// MatchAll returns every route matching subject, one per rank at most, in
+// rank order, without invoking any handler. The first one is the route
+// ServeNATS dispatches to. This is e.g. useful to find out why a subject hit
+// a handler, or which ones it shadows.
+func (r *Router) MatchAll(subject string) []Match {
+	found := r.matchAll(r.matchPath(subject))
+	if found == nil {
+		return nil
+	}
+
+	matches := make([]Match, len(found))
+	for i, m := range found {
+		matches[i] = Match{Pattern: m.meta.Pattern, Rank: m.rank, Handle: m.handle}
+		if m.ps != nil {
+			matches[i].Params = *m.ps
+		}
+	}
+
+	return matches
+}
+
+// matched is a route matching a path, see matchAll.
+type matched struct {
+	handle Handle
+	// Not pooled
+	ps   *Params
+	leaf *node
+	rank int
+	meta RouteMeta
+}
+
+// matchAll returns the routes of every rank matching path, in rank order, or
+// the fallback route matching it if none.
+func (r *Router) matchAll(path string) []matched {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	newParams := func() *Params {
+		ps := make(Params, 0, r.maxParams)
+
+		return &ps
+	}
+
+	// Capped, so that appending never writes to the shared rank list
+	ranks := r.rankList()
+	var matches []matched
+	for _, rank := range append(ranks[:len(ranks):len(ranks)], FallbackRank) {
+		root := r.trees[rank]
+		if root == nil || (rank == FallbackRank && len(matches) > 0) {
+			continue
+		}
+		handle, ps, leaf, _ := root.getValue(path, newParams, r.TrimCatchAllDot)
+		if handle == nil {
+			continue
+		}
+		if ps != nil && r.splitsCatchAll(leaf) {
+			r.splitCatchAll(ps)
+		}
+		matches = append(matches, matched{handle: handle, ps: ps, leaf: leaf, rank: rank, meta: r.routeMeta(leaf, rank)})
+	}
+
+	return matches
+}
+
+// patternOf returns the pattern registered with the given path and rank.
+// The caller must hold r.mu.
+func (r *Router) patternOf(path string, rank int) string {
+	for _, route := range r.routes {
+		if route.Rank == rank && route.Path == path {
+			return route.Pattern
+		}
+	}
+
+	return ""
+}
+
+// anyRank tells serve to try the routes of every rank, then the fallback ones.
+const anyRank = -1
+
+// serve dispatches msg to the handler of the first rank matching its subject
+// and returns the pattern and rank of the matched route.
+// If provide is not nil, it replaces payload once the route is known.
+// If only is not anyRank, just the routes of that rank are tried.
+func (r *Router) serve(msg SubjectMsg, payload interface{}, provide func(string, int) interface{}, only int) (string, int, error) {
+	if msg == nil {
+		return "", 0, ErrNilMessage
+	}
+	if r.recovers() {
 		defer r.recv(msg)
 	}
 
-	path := msg.GetSubject()
+	path, err := r.admit(msg, payload)
+	if err != nil {
+		return "", 0, err
+	}
 
-	rankList := r.getRankList()
-	for _, rank := range rankList {
-		if root := r.trees[rank]; root != nil {
-			if handle, ps, _ := root.getValue(path, r.getParams); handle != nil {
-				if ps != nil {
-					go func() {
-						handle(msg, *ps, payload)
-						r.putParams(ps)
-					}()
-				} else {
-					go func() {
-						handle(msg, nil, payload)
-					}()
-				}
+	var (
+		handle Handle
+		ps     *Params
+		leaf   *node
+		rank   int
+	)
+	if only != anyRank {
+		r.mu.RLock()
+		handle, ps, leaf = r.matchTree(path, only)
+		r.mu.RUnlock()
+		rank = only
+	} else {
+		handle, ps, leaf, rank = r.match(path)
+	}
+
+	if handle != nil {
+		if r.expired(ps) {
+			r.putParams(ps)
+			if r.ExpiredHandler != nil {
+				r.ExpiredHandler(msg, payload)
+			}
+
+			return "", 0, ErrExpired
+		}
+		if provide != nil {
+			payload = provide(leaf.pattern, rank)
+		} else if payload == nil {
+			payload = leaf.payload
+		}
+		switch {
+		case leaf.inline:
+			r.call(handle, msg, ps, payload, leaf, rank)
+		case r.OrderingKey != nil:
+			r.worker(r.OrderingKey(msg)) <- func() {
+				r.call(handle, msg, ps, payload, leaf, rank)
+			}
+		case r.Executor != nil:
+			r.Executor.Go(func() {
+				r.call(handle, msg, ps, payload, leaf, rank)
+			})
+		default:
+			go r.call(handle, msg, ps, payload, leaf, rank)
+		}
+
+		return leaf.pattern, rank, nil
+	}
+
+	return "", 0, r.notFound(msg, payload)
+}
 
-				return nil
+// expired reports whether the params of a match carry an expiry which has
+// passed, see ExpiryFromParams.
+func (r *Router) expired(ps *Params) bool {
+	if r.ExpiryFromParams == nil || ps == nil {
+		return false
+	}
+	expiry, ok := r.ExpiryFromParams(*ps)
+
+	return ok && !time.Now().Before(expiry)
+}
+
+// subjectOf returns the subject msg is routed on.
+func (r *Router) subjectOf(msg SubjectMsg) string {
+	if r.SubjectFunc != nil {
+		return r.SubjectFunc(msg)
+	}
+
+	return msg.GetSubject()
+}
+
+// admit runs the checks preceding the matching of msg, and returns the path
+// to match its subject as.
+func (r *Router) admit(msg SubjectMsg, payload interface{}) (string, error) {
+	if d, ok := msg.(Deadliner); ok {
+		if deadline, ok := d.Deadline(); ok && !time.Now().Before(deadline) {
+			if r.ExpiredHandler != nil {
+				r.ExpiredHandler(msg, payload)
 			}
+
+			return "", ErrExpired
+		}
+	}
+
+	path := r.subjectOf(msg)
+	if r.MaxSubjectLen > 0 && len(path) > r.MaxSubjectLen {
+		return "", ErrSubjectTooLong
+	}
+	path = r.matchPath(path)
+	if r.ValidateIncoming {
+		if err := validateSubject(path); err != nil {
+			return "", err
+		}
+	}
+
+	if r.Authorize != nil && !r.Authorize(path, msg) {
+		if r.UnauthorizedHandler != nil {
+			r.UnauthorizedHandler(msg, payload)
+		}
+
+		return "", ErrUnauthorized
+	}
+
+	return path, nil
+}
+
+// notFound handles a message matching no route, and returns the error to
+// report.
+func (r *Router) notFound(msg SubjectMsg, payload interface{}) error {
+	if r.NotFoundHandler != nil {
+		if r.NotFoundAsync {
+			r.goExec(func() {
+				if r.recovers() {
+					defer r.recv(msg)
+				}
+				r.NotFoundHandler(msg, payload)
+			})
+		} else {
+			r.NotFoundHandler(msg, payload)
+		}
+	}
+	if r.NotFoundReply != nil {
+		r.replyNotFound(msg)
+	}
+
+	if r.NotFoundError != nil {
+		return &notFoundError{err: r.NotFoundError}
+	}
+
+	return ErrNotFound
+}
+
+// ServeNATS makes the router implement interface.
+//
+// Handles may serve messages again, e.g. to compose routers, including
+// synchronously from an inline handle: the params of a handle are returned
+// to the pool only once it completes, so nested calls never share them.
+// A nested call waiting on the handle itself deadlocks though, as with a
+// concurrency limit of 1 or the worker of the same OrderingKey.
+func (r *Router) ServeNATS(msg SubjectMsg) error {
+	_, _, err := r.serve(msg, nil, nil, anyRank)
+
+	return err
+}
+
+// ServeNATSMatched works like ServeNATS, but also returns the pattern, as
+// passed to Handle, and rank of the route which handled the message, e.g.
+// for logging. On a miss it returns an empty pattern and ErrNotFound.
+func (r *Router) ServeNATSMatched(msg SubjectMsg) (pattern string, rank int, err error) {
+	return r.serve(msg, nil, nil, anyRank)
+}
+
+// ServeNATSCount works like ServeNATS, but also returns the number of
+// handlers the message was dispatched to, e.g. 1 on a match and 0 on a miss.
+func (r *Router) ServeNATSCount(msg SubjectMsg) (int, error) {
+	pattern, _, err := r.serve(msg, nil, nil, anyRank)
+	if pattern == "" {
+		return 0, err
+	}
+
+	return 1, err
+}
+
+// ServeNATSAll works like ServeNATS, but dispatches msg to the routes of
+// every rank matching its subject, and returns how many. The handles run one
+// after the other, in rank order or as sorted by HandlerOrder, in a single
+// goroutine, or on the worker of the message if OrderingKey is set.
+func (r *Router) ServeNATSAll(msg SubjectMsg) (int, error) {
+	if msg == nil {
+		return 0, ErrNilMessage
+	}
+	if r.recovers() {
+		defer r.recv(msg)
+	}
+
+	path, err := r.admit(msg, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	matches := r.matchAll(path)
+	if len(matches) == 0 {
+		return 0, r.notFound(msg, nil)
+	}
+	live := matches[:0]
+	for _, m := range matches {
+		if !r.expired(m.ps) {
+			live = append(live, m)
+		}
+	}
+	if matches = live; len(matches) == 0 {
+		if r.ExpiredHandler != nil {
+			r.ExpiredHandler(msg, nil)
+		}
+
+		return 0, ErrExpired
+	}
+	if r.HandlerOrder != nil {
+		sort.SliceStable(matches, func(i, j int) bool {
+			return r.HandlerOrder(matches[i].meta, matches[j].meta)
+		})
+	}
+
+	run := func() {
+		for _, m := range matches {
+			r.call(m.handle, msg, m.ps, m.leaf.payload, m.leaf, m.rank)
+		}
+	}
+	if r.OrderingKey != nil {
+		r.worker(r.OrderingKey(msg)) <- run
+	} else {
+		r.goExec(run)
+	}
+
+	return len(matches), nil
+}
+
+// Resolve matches msg like ServeNATS, but instead of dispatching it returns
+// the matched handle as a function, along with its params, so that the
+// caller runs it when and where it sees fit, e.g. from a workflow engine.
+// The function runs the handle in the calling goroutine, with the given
+// payload or the default one of the route if nil, and applies the settings
+// of the route as ServeNATS does, like its concurrency limit. It may be
+// called more than once. The params are a copy, owned by the caller.
+// Misses are reported to the configured hooks and returned as ErrNotFound.
+func (r *Router) Resolve(msg SubjectMsg) (func(payload interface{}), Params, error) {
+	if msg == nil {
+		return nil, nil, ErrNilMessage
+	}
+	if r.recovers() {
+		defer r.recv(msg)
+	}
+
+	path, err := r.admit(msg, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handle, ps, leaf, rank := r.match(path)
+	if handle == nil {
+		return nil, nil, r.notFound(msg, nil)
+	}
+	if r.expired(ps) {
+		r.putParams(ps)
+		if r.ExpiredHandler != nil {
+			r.ExpiredHandler(msg, nil)
+		}
+
+		return nil, nil, ErrExpired
+	}
+
+	var params Params
+	if ps != nil && len(*ps) > 0 {
+		params = make(Params, len(*ps))
+		copy(params, *ps)
+	}
+	r.putParams(ps)
+
+	run := func(payload interface{}) {
+		if payload == nil {
+			payload = leaf.payload
+		}
+		var own *Params
+		if params != nil {
+			// call returns the params to the pool: never hand it ours
+			cp := make(Params, len(params), len(params)+1)
+			copy(cp, params)
+			own = &cp
+		}
+		r.call(handle, msg, own, payload, leaf, rank)
+	}
+
+	return run, params, nil
+}
+
+// ServeNATSWithProvider works like ServeNATSWithPayload, but the payload is
+// computed by provide from the pattern, as passed to Handle, and rank of the
+// matched route, e.g. to inject per-route dependencies.
+// provide is only called on a match.
+func (r *Router) ServeNATSWithProvider(msg SubjectMsg, provide func(pattern string, rank int) interface{}) error {
+	_, _, err := r.serve(msg, nil, provide, anyRank)
+
+	return err
+}
+
+func (r *Router) ServeNATSWithPayload(msg SubjectMsg, payload interface{}) error {
+	_, _, err := r.serve(msg, payload, nil, anyRank)
+
+	return err
+}
+
+// ServeRank works like ServeNATSWithPayload, but only tries the routes of the
+// given rank, e.g. for frameworks driving the ranks explicitly, or of the
+// fallback routes for FallbackRank. Messages missing the rank are handled as
+// not found. Ranks out of range are rejected with ErrUnknownRank.
+func (r *Router) ServeRank(rank int, msg SubjectMsg, payload interface{}) error {
+	if rank < FallbackRank || rank > 255 {
+		return fmt.Errorf("%w %d", ErrUnknownRank, rank)
+	}
+	_, _, err := r.serve(msg, payload, nil, rank)
+
+	return err
+}
+
+// Replay routes the messages pulled from source, e.g. a file or a JetStream
+// history, through the current routes, until source reports it is done or
+// ctx is canceled. Messages are served like by ServeNATS, so handlers run
+// according to the router options. Misses are reported like by MsgHandler
+// and do not stop the replay.
+// It returns ctx.Err() if canceled, nil otherwise.
+func (r *Router) Replay(ctx context.Context, source func() (SubjectMsg, bool)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		msg, ok := source()
+		if !ok {
+			return nil
+		}
+		if err := r.ServeNATS(msg); err != nil && r.ErrorHandler != nil && !r.hooked(err) {
+			r.ErrorHandler(msg, err)
 		}
 	}
-	// Handle 404
-	return errors.New("404 NotFound")
 }
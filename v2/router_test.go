@@ -1,11 +1,21 @@
 package natsrouter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/nats-io/nats.go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,6 +71,105 @@ func catchPanic(testFunc func()) (recv interface{}) {
 func TestPathCathAll(t *testing.T) {
 	assert.Equal(t, "user.*>", fromNatsPath("user.>"))
 	assert.Equal(t, "user.:p1.:p2.*>", fromNatsPath("user.*.*.>"))
+	assert.Equal(t, ":p1.foo", fromNatsPath("*.foo"))
+	assert.Equal(t, ":p1.events.*>", fromNatsPath("*.events.>"))
+	assert.Equal(t, ":p1.:p2.events", fromNatsPath("*.*.events"))
+}
+
+func TestRouterLeadingWildcard(t *testing.T) {
+	router := New()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	router.Handle("*.events.>", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		want := Params{
+			Param{"p1", "tenant"},
+			Param{">", ".created"},
+		}
+		if !reflect.DeepEqual(ps, want) {
+			t.Fatalf("wrong wildcard values: want %v, got %v", want, ps)
+		}
+	})
+
+	err := router.ServeNATS(NewMessage("tenant.events.created"))
+	wg.Wait()
+	assert.NoError(t, err)
+}
+
+func TestRouterLeadingToken(t *testing.T) {
+	router := New()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	routed := false
+	router.Handle("*.foo", 1, func(msg SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		routed = true
+		want := Params{Param{"p1", "gopher"}}
+		if !reflect.DeepEqual(ps, want) {
+			t.Fatalf("wrong wildcard values: want %v, got %v", want, ps)
+		}
+	})
+
+	_ = router.ServeNATS(NewMessage("gopher.foo"))
+	wg.Wait()
+	assert.True(t, routed)
+}
+
+func TestJoinSplit(t *testing.T) {
+	assert.Equal(t, "ROUTING.v2.HR.>", Join("ROUTING.v2", "HR", ">"))
+	assert.Equal(t, "ROUTING.v2.>", Join("ROUTING.v2.", "", ".>"))
+	assert.Equal(t, "", Join())
+	assert.Equal(t, []string{"ROUTING", "v2", "*", ">"}, Split("ROUTING.v2.*.>"))
+	assert.Nil(t, Split(""))
+}
+
+func TestRouterStrict(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.Strict = true
+	for i, pattern := range []string{
+		"user.*.>",
+		"user.:name.ok",
+		"*.events.>",
+	} {
+		assert.NoError(t, router.HandleE(pattern, i+1, handlerFunc), pattern)
+	}
+	for pattern, msg := range map[string]string{
+		"":         "empty pattern",
+		"a..b":     "empty token 2 in pattern 'a..b'",
+		"a.>.b":    "'>' must be the last token in pattern 'a.>.b'",
+		"a.b*":     "wildcard mixed with other characters in token 'b*' of pattern 'a.b*'",
+		"a.b:c":    "':' must start the token 'b:c' of pattern 'a.b:c'",
+		"a.:":      "unnamed param in pattern 'a.:'",
+		"a.b c":    "invalid character ' ' in token 'b c' of pattern 'a.b c'",
+		"a.b\x00c": "invalid character '\\x00' in token 'b\x00c' of pattern 'a.b\x00c'",
+	} {
+		assert.EqualError(t, router.HandleE(pattern, 4, handlerFunc), msg)
+	}
+}
+
+func TestRouterSysSubject(t *testing.T) {
+	router := New()
+	router.SaveMatchedRoutePath = true
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	router.Handle("$SYS.*.>", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		assert.Equal(t, "SERVER", ps.ByName("p1"))
+		assert.Equal(t, ".ping", ps.ByName(">"))
+		assert.Equal(t, "$SYS.:p1.*>", ps.MatchedRoutePath())
+		assert.Equal(t, "p1=SERVER, >=.ping", ps.String())
+		assert.Equal(t, Params{{"p1", "SERVER"}, {">", ".ping"}}, ps.UserParams())
+	})
+
+	assert.NoError(t, router.ServeNATS(NewMessage("$SYS.SERVER.ping")))
+	wg.Wait()
+
+	assert.Error(t, router.HandleE("user.:$matchedRoutePath", 2, func(_ SubjectMsg, _ Params, _ interface{}) {}))
 }
 
 func TestParams(t *testing.T) {
@@ -79,6 +188,95 @@ func TestParams(t *testing.T) {
 	}
 }
 
+func TestParamsString(t *testing.T) {
+	ps := Params{
+		Param{"name", "gopher"},
+		Param{"region", "eu"},
+		Param{MatchedRoutePathParam, "user.:name.:region"},
+	}
+	assert.Equal(t, "name=gopher, region=eu", ps.String())
+	assert.Equal(t, "name=gopher, region=eu", fmt.Sprint(ps))
+	assert.Equal(t, "name=gopher, region=eu, $matchedRoutePath=user.:name.:region", ps.StringAll())
+	assert.Equal(t, "", Params(nil).String())
+}
+
+func TestParamsUserParams(t *testing.T) {
+	ps := Params{
+		Param{"name", "gopher"},
+		Param{MatchedRoutePathParam, "user.:name.:region"},
+		Param{"region", "eu"},
+	}
+	assert.Equal(t, Params{{"name", "gopher"}, {"region", "eu"}}, ps.UserParams())
+	assert.Len(t, ps, 3)
+
+	user := Params{{"name", "gopher"}}
+	assert.True(t, reflect.DeepEqual(user, user.UserParams()))
+	assert.Nil(t, Params(nil).UserParams())
+}
+
+func TestParamsWith(t *testing.T) {
+	ps := make(Params, 1, 4)
+	ps[0] = NewParam("name", "gopher")
+
+	with := ps.With("role", "admin")
+	assert.Equal(t, Params{{"name", "gopher"}, {"role", "admin"}}, with)
+	assert.Equal(t, Params{{"name", "gopher"}}, ps)
+	assert.Equal(t, Param{}, ps[:2][1], "the backing array of ps is not written")
+
+	replaced := with.With("name", "other")
+	assert.Equal(t, Params{{"name", "other"}, {"role", "admin"}}, replaced)
+	assert.Equal(t, "gopher", with.ByName("name"))
+
+	assert.Equal(t, Params{{"name", "gopher"}}, Params(nil).With("name", "gopher"))
+}
+
+func TestParamsFirstLast(t *testing.T) {
+	ps := Params{
+		Param{"param1", "value1"},
+		Param{">", ".value2"},
+	}
+	assert.Equal(t, 2, ps.Len())
+	first, ok := ps.First()
+	assert.True(t, ok)
+	assert.Equal(t, Param{"param1", "value1"}, first)
+	last, ok := ps.Last()
+	assert.True(t, ok)
+	assert.Equal(t, Param{">", ".value2"}, last)
+
+	var empty Params
+	assert.Equal(t, 0, empty.Len())
+	_, ok = empty.First()
+	assert.False(t, ok)
+	_, ok = empty.Last()
+	assert.False(t, ok)
+}
+
+func TestParamsSortedByKey(t *testing.T) {
+	ps := Params{
+		{"p2", "b"},
+		{"p1", "a"},
+		{"$matchedRoutePath", "x.*.*"},
+		{"p1", "c"},
+	}
+
+	sorted := ps.SortedByKey()
+	assert.Equal(t, Params{
+		{"$matchedRoutePath", "x.*.*"},
+		{"p1", "a"},
+		{"p1", "c"},
+		{"p2", "b"},
+	}, sorted)
+	assert.Equal(t, Params{
+		{"p2", "b"},
+		{"p1", "a"},
+		{"$matchedRoutePath", "x.*.*"},
+		{"p1", "c"},
+	}, ps, "ps is left untouched")
+
+	assert.Nil(t, Params(nil).SortedByKey())
+	assert.Equal(t, Params{}, Params{}.SortedByKey())
+}
+
 func TestRouter(t *testing.T) {
 	router := New()
 
@@ -131,6 +329,107 @@ func TestRouterCatchAll(t *testing.T) {
 	}
 }
 
+// The catch-all value keeps the leading separator unless
+// Router.TrimCatchAllDot is set: consumers rely on it, so it must not change.
+func TestRouterCatchAllLeadingDot(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.Handle("user.>", 1, handlerFunc)
+	router.Handle("user.*.v1.>", 2, handlerFunc)
+
+	_, ps, _ := router.Lookup("user.gopher", 1)
+	assert.Equal(t, ".gopher", ps.ByName(">"))
+
+	_, ps, _ = router.Lookup("user.gopher.star.ok", 1)
+	assert.Equal(t, ".gopher.star.ok", ps.ByName(">"))
+
+	_, ps, _ = router.Lookup("user.gopher.v1.ok", 2)
+	assert.Equal(t, "gopher", ps.ByName("p1"))
+	assert.Equal(t, ".ok", ps.ByName(">"))
+}
+
+// The catch-all value is the same in v1 and v2: keep this test in sync with
+// its copy in the other module's router_test.go.
+func TestRouterCatchAllValueParity(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		rank             int
+		value, trimmed   string
+	}{
+		{"user.>", "user.gopher", 1, ".gopher", "gopher"},
+		{"user.>", "user.gopher.star.ok", 4, ".gopher.star.ok", "gopher.star.ok"},
+		{"user.*.v1.>", "user.gopher.v1.ok", 2, ".ok", "ok"},
+	}
+
+	for _, trim := range []bool{false, true} {
+		router := New()
+		router.TrimCatchAllDot = trim
+		for _, tt := range tests {
+			router.Handle(tt.pattern, tt.rank, func(_ SubjectMsg, _ Params, _ interface{}) {})
+		}
+		for _, tt := range tests {
+			handle, ps, _ := router.Lookup(tt.subject, tt.rank)
+			assert.NotNil(t, handle, tt.pattern)
+			want := tt.value
+			if trim {
+				want = tt.trimmed
+			}
+			assert.Equal(t, want, ps.ByName(">"), "%s with TrimCatchAllDot=%t", tt.pattern, trim)
+		}
+	}
+}
+
+func TestRouterTrimCatchAllDot(t *testing.T) {
+	router := New()
+	router.TrimCatchAllDot = true
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	routed := false
+	router.Handle("user.*.>", 1, func(msg SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		routed = true
+		want := Params{
+			Param{"p1", "gopher"},
+			Param{">", "star.ok"},
+		}
+		if !reflect.DeepEqual(ps, want) {
+			t.Fatalf("wrong wildcard values: want %v, got %v", want, ps)
+		}
+	})
+
+	msg := NewMessage("user.gopher.star.ok")
+	_ = router.ServeNATS(msg)
+	wg.Wait()
+	assert.True(t, routed)
+
+	_, ps, _ := router.Lookup("user.gopher.star.ok", 1)
+	assert.Equal(t, "star.ok", ps.ByName(">"))
+}
+
+func TestRouterSplitCatchAll(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.SplitCatchAll = true
+	router.Handle("user.*.>", 1, handlerFunc)
+	router.Handle("user.:name", 2, handlerFunc)
+
+	want := Params{
+		{"p1", "gopher"},
+		{">", ".star.ok"},
+		{">0", "star"},
+		{">1", "ok"},
+	}
+	_, ps, _ := router.Lookup("user.gopher.star.ok", 1)
+	assert.Equal(t, want, ps)
+
+	result := router.DryRun([]string{"user.gopher.star.ok", "user.gopher"})
+	assert.Equal(t, want, result["user.gopher.star.ok"].Params)
+	assert.Equal(t, Params{{"name", "gopher"}}, result["user.gopher"].Params)
+}
+
 func TestRouterMulti(t *testing.T) {
 	router := New()
 	var wg sync.WaitGroup
@@ -170,17 +469,11 @@ func TestRouterMulti(t *testing.T) {
 }
 
 func getRoutingSubscription(subtopic string, star bool) string {
-	var subject string
-	if subtopic == "" {
-		subject = "ROUTING.v2"
-	} else {
-		subject = fmt.Sprintf("%s.%s", "ROUTING.v2", subtopic)
-	}
 	if star {
-		return subject + ".>"
+		return Join("ROUTING.v2", subtopic, ">")
 	}
 
-	return subject
+	return Join("ROUTING.v2", subtopic)
 }
 
 func TestRouterMulti2(t *testing.T) {
@@ -319,6 +612,153 @@ func TestRouterInvalidInput(t *testing.T) {
 	}
 }
 
+type countingHandler struct {
+	wg    *sync.WaitGroup
+	calls int
+}
+
+func (h *countingHandler) ServeNATS(_ SubjectMsg, _ Params, _ interface{}) {
+	defer h.wg.Done()
+	h.calls++
+}
+
+func TestRouterHandleObject(t *testing.T) {
+	router := New()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	handler := &countingHandler{wg: &wg}
+	router.HandleObject("user.:name", 1, handler)
+
+	_ = router.ServeNATS(NewMessage("user.gopher"))
+	wg.Wait()
+	assert.Equal(t, 1, handler.calls)
+
+	var _ Handler = Handle(nil)
+}
+
+// The per-route settings are set along with the route, so that observers of
+// the change, and messages served meanwhile, see them.
+func TestRouterRouteOptionsOnChange(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	// The first observation of each route, on its registration
+	seen := make(map[string]RouteMeta)
+	var payload interface{}
+	router.OnChange = func() {
+		for _, meta := range router.Inspect() {
+			if _, ok := seen[meta.Pattern]; !ok {
+				seen[meta.Pattern] = meta
+			}
+		}
+		if payload == nil {
+			router.mu.RLock()
+			if n := router.findNode("c", 1); n != nil {
+				payload = n.payload
+			}
+			router.mu.RUnlock()
+		}
+	}
+	router.HandleInline("a", 1, handlerFunc)
+	router.HandleWithConcurrency("b", 1, 3, handlerFunc)
+	router.HandleWithDefaultPayload("c", 1, "payload", handlerFunc)
+
+	assert.True(t, seen["a"].Inline)
+	assert.Equal(t, 3, seen["b"].ConcurrencyLimit)
+	assert.Equal(t, "payload", payload)
+}
+
+func TestRouterHandleInline(t *testing.T) {
+	router := New()
+
+	var order []string
+	router.HandleInline("user.:name", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		order = append(order, ps.ByName("name"))
+	})
+	router.HandleInline("user.:name.>", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		order = append(order, ps.ByName(">"))
+	})
+
+	for _, subject := range []string{"user.a", "user.b", "user.c.d", "user.e"} {
+		assert.NoError(t, router.ServeNATS(NewMessage(subject)))
+	}
+	assert.Equal(t, []string{"a", "b", ".d", "e"}, order)
+}
+
+func TestRouterHandleMultiSequential(t *testing.T) {
+	router := New()
+
+	var errs []error
+	router.ErrorHandler = func(_ SubjectMsg, err error) {
+		errs = append(errs, err)
+	}
+	errBoom := errors.New("boom")
+
+	var calls []string
+	step := func(name string, err error) ChainHandle {
+		return func(_ SubjectMsg, _ Params, _ interface{}) error {
+			calls = append(calls, name)
+
+			return err
+		}
+	}
+	router.HandleMulti("a", 1, MultiOptions{Sequential: true},
+		step("a1", nil), step("a2", errBoom), step("a3", ErrPass), step("a4", nil))
+	router.HandleMulti("b", 1, MultiOptions{Sequential: true, StopOnError: true},
+		step("b1", errBoom), step("b2", nil))
+
+	// Run the chains synchronously through their registered handles
+	for _, subject := range []string{"a", "b"} {
+		handle, _, _ := router.Lookup(subject, 1)
+		handle(NewMessage(subject), nil, nil)
+	}
+	assert.Equal(t, []string{"a1", "a2", "a3", "b1"}, calls)
+	assert.Equal(t, []error{errBoom, errBoom}, errs)
+}
+
+func TestRouterHandleMultiConcurrent(t *testing.T) {
+	router := New()
+
+	var (
+		mu    sync.Mutex
+		calls int
+		errs  int
+	)
+	router.ErrorHandler = func(_ SubjectMsg, _ error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs++
+	}
+	handle := func(err error) ChainHandle {
+		return func(_ SubjectMsg, ps Params, _ interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			assert.Equal(t, "gopher", ps.ByName("name"))
+
+			return err
+		}
+	}
+	router.HandleMulti("user.:name", 1, MultiOptions{},
+		handle(nil), handle(ErrPass), handle(errors.New("boom")))
+
+	h, ps, _ := router.Lookup("user.gopher", 1)
+	h(NewMessage("user.gopher"), ps, nil)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 1, errs)
+}
+
+func TestRouterHandleE(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	assert.ErrorIs(t, router.HandleE("input.>", 1, nil), ErrNilHandler)
+	assert.NoError(t, router.HandleE("input.:id", 1, handlerFunc))
+	assert.EqualError(t, router.HandleE("input.:id", 1, handlerFunc),
+		"a handle is already registered for path 'input.:id'")
+	assert.Error(t, router.HandleE("input.>", 0, handlerFunc))
+}
+
 func BenchmarkAllowed(b *testing.B) {
 	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
 
@@ -346,14 +786,2630 @@ func BenchmarkAllowed(b *testing.B) {
 	})
 }
 
-func TestRankList(t *testing.T) {
-	r := New()
-	r.rankIndexList = []int{2, 4, 1, 3}
-	assert.False(t, r.initialized)
-	rankList := r.getRankList()
-	assert.True(t, r.initialized)
-	assert.Equal(t, 1, rankList[0])
-	assert.Equal(t, 2, rankList[1])
-	assert.Equal(t, 3, rankList[2])
-	assert.Equal(t, 4, rankList[3])
+func TestRouterDisableParamsPool(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.DisableParamsPool = true
+	router.Handle("user.:name.>", 1, handlerFunc)
+
+	_, ps1, _ := router.Lookup("user.gopher.ok", 1)
+	_, ps2, _ := router.Lookup("user.other.ko", 1)
+	assert.Equal(t, "gopher", ps1.ByName("name"))
+	assert.Equal(t, "other", ps2.ByName("name"))
+	assert.Equal(t, 2, cap(ps1))
+	assert.NotSame(t, &ps1[0], &ps2[0])
+}
+
+func TestRouterHandleNats(t *testing.T) {
+	router := New()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	routed := false
+	var errMsg error
+	router.ErrorHandler = func(_ SubjectMsg, err error) {
+		defer wg.Done()
+		errMsg = err
+	}
+	router.HandleNats("user.:name", 1, func(msg *nats.Msg, ps Params, _ interface{}) {
+		defer wg.Done()
+		routed = true
+		assert.Equal(t, "user.gopher", msg.Subject)
+		assert.Equal(t, "gopher", ps.ByName("name"))
+	})
+
+	_ = router.ServeNATS(&Msg{msg: &nats.Msg{Subject: "user.gopher"}, sub: "user.gopher"})
+	_ = router.ServeNATS(NewMessage("user.fake"))
+	wg.Wait()
+	assert.True(t, routed)
+	assert.ErrorIs(t, errMsg, ErrNotNatsMsg)
+}
+
+func TestRouterSubjects(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.Handle("ROUTING.v2.>", 2, handlerFunc)
+	router.Handle("ROUTING.v2.FEEDBACK.>", 1, handlerFunc)
+	router.Handle("AAA.>", 1, handlerFunc)
+	router.Handle("AAA.>", 2, handlerFunc)
+	router.Handle("user.:name.*.>", 3, handlerFunc)
+	router.Handle("user.*.*.>", 1, handlerFunc)
+
+	assert.Equal(t, []string{
+		"ROUTING.v2.FEEDBACK.>",
+		"AAA.>",
+		"user.*.*.>",
+		"ROUTING.v2.>",
+	}, router.Subjects())
+}
+
+func TestRouterServeNATSMatched(t *testing.T) {
+	router := New()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	router.Handle("ROUTING.v2.FEEDBACK.>", 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		wg.Done()
+	})
+
+	pattern, rank, err := router.ServeNATSMatched(NewMessage("ROUTING.v2.FEEDBACK.test"))
+	wg.Wait()
+	assert.NoError(t, err)
+	assert.Equal(t, "ROUTING.v2.FEEDBACK.>", pattern)
+	assert.Equal(t, 2, rank)
+
+	pattern, rank, err = router.ServeNATSMatched(NewMessage("ROUTING.v1.FEEDBACK.test"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, "", pattern)
+	assert.Equal(t, 0, rank)
+}
+
+func TestRouterHandleFactory(t *testing.T) {
+	router := New()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		built int
+		calls int
+	)
+	router.HandleFactory("user.:name", 1, func() Handle {
+		mu.Lock()
+		built++
+		mu.Unlock()
+
+		return func(_ SubjectMsg, ps Params, _ interface{}) {
+			defer wg.Done()
+			mu.Lock()
+			calls++
+			mu.Unlock()
+		}
+	})
+	router.HandleFactory("never.:name", 1, func() Handle {
+		t.Fatal("factory of a route that never fires must not run")
+
+		return nil
+	})
+
+	const n = 10
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		_ = router.ServeNATS(NewMessage("user.gopher"))
+	}
+	wg.Wait()
+	assert.Equal(t, 1, built)
+	assert.Equal(t, n, calls)
+}
+
+func TestRouterHandleFactoryPanic(t *testing.T) {
+	router := New()
+	router.Executor = InlineExecutor
+	var panics []interface{}
+	router.PanicHandler = func(_ SubjectMsg, rcv interface{}) {
+		panics = append(panics, rcv)
+	}
+
+	var built, calls int
+	router.HandleFactory("user.:name", 1, func() Handle {
+		if built++; built == 1 {
+			panic("not ready")
+		}
+
+		return func(_ SubjectMsg, _ Params, _ interface{}) {
+			calls++
+		}
+	})
+
+	// A panicking factory leaves the route to build again
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	assert.Equal(t, []interface{}{"not ready"}, panics)
+	assert.Zero(t, calls)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gordon")))
+	assert.Equal(t, 2, built)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, panics, 1)
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	assert.Equal(t, "a.b", normalizeSubject("a.b"))
+	assert.Equal(t, "a.b", normalizeSubject("a..b"))
+	assert.Equal(t, "a.b.c", normalizeSubject(".a...b.c.."))
+	assert.Equal(t, "", normalizeSubject(".."))
+}
+
+func TestRouterNormalizeSubject(t *testing.T) {
+	router := New()
+	router.NormalizeSubject = true
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	router.Handle("user.:name.ok", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		assert.Equal(t, "gopher", ps.ByName("name"))
+	})
+
+	err := router.ServeNATS(NewMessage("user..gopher.ok."))
+	wg.Wait()
+	assert.NoError(t, err)
+
+	router.NormalizeSubject = false
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("user..gopher.ok")), ErrNotFound)
+}
+
+func TestRouterUnreachableRoutes(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.Handle("ROUTING.v2.>", 1, handlerFunc)
+	router.Handle("ROUTING.v2.FEEDBACK.>", 2, handlerFunc)
+	router.Handle("ROUTING.:version.>", 3, handlerFunc)
+	router.Handle("user.*.ok", 1, handlerFunc)
+	router.Handle("user.gopher.ok", 2, handlerFunc)
+	router.Handle("user.gopher.ko", 2, handlerFunc)
+	router.Handle("user.*", 3, handlerFunc)
+
+	assert.Equal(t, []RouteInfo{
+		{Pattern: "ROUTING.v2.FEEDBACK.>", Path: "ROUTING.v2.FEEDBACK.*>", Rank: 2},
+		{Pattern: "user.gopher.ok", Path: "user.gopher.ok", Rank: 2},
+	}, router.UnreachableRoutes())
+
+	// Fallback routes are served after every rank
+	router = New()
+	router.HandleFallback("A.>", handlerFunc)
+	router.Handle("A.b", 1, handlerFunc)
+	router.HandleFallback("B.*", handlerFunc)
+	router.Handle("B.>", 1, handlerFunc)
+	assert.Equal(t, []RouteInfo{
+		{Pattern: "B.*", Path: "B.:p1", Rank: FallbackRank},
+	}, router.UnreachableRoutes())
+}
+
+func TestRouterParamsPoolStats(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.Handle("user.:name", 1, handlerFunc)
+	router.Handle("user.:name.:action.>", 2, handlerFunc)
+	assert.Equal(t, PoolStats{MaxParams: 3}, router.ParamsPoolStats())
+
+	_, _, _ = router.Lookup("user.gopher", 1)
+	stats := router.ParamsPoolStats()
+	assert.Equal(t, uint64(1), stats.Gets)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
+
+type replyMsg struct {
+	Msg
+	reply []byte
+}
+
+func (m *replyMsg) Respond(data []byte) error {
+	m.reply = data
+
+	return nil
+}
+
+func TestRouterNotFoundReply(t *testing.T) {
+	router := New()
+	router.NotFoundReply = func(msg SubjectMsg) []byte {
+		return []byte("no route for " + msg.GetSubject())
+	}
+
+	msg := &replyMsg{Msg: Msg{sub: "user.gopher"}}
+	assert.ErrorIs(t, router.ServeNATS(msg), ErrNotFound)
+	assert.Equal(t, "no route for user.gopher", string(msg.reply))
+
+	// A *nats.Msg without a reply subject is not answered
+	errs := 0
+	router.ErrorHandler = func(SubjectMsg, error) { errs++ }
+	assert.ErrorIs(t, router.ServeNATS(NewNatsMsg(&nats.Msg{Subject: "user.gopher"})), ErrNotFound)
+	assert.Equal(t, 0, errs)
+}
+
+func TestRouterRanks(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	assert.Empty(t, router.Ranks())
+	router.Handle("a.>", 3, handlerFunc)
+	router.Handle("b.>", 1, handlerFunc)
+	assert.Equal(t, []int{1, 3}, router.Ranks())
+
+	// New ranks are picked up after the list has been built
+	router.Handle("c.>", 2, handlerFunc)
+	ranks := router.Ranks()
+	assert.Equal(t, []int{1, 2, 3}, ranks)
+
+	ranks[0] = 42
+	assert.Equal(t, []int{1, 2, 3}, router.Ranks())
+}
+
+func TestRouterLookupPattern(t *testing.T) {
+	router := New()
+
+	called := ""
+	router.Handle("user.*.>", 1, func(_ SubjectMsg, _ Params, _ interface{}) {
+		called = "user.*.>"
+	})
+	router.Handle("user.:name.ok", 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		called = "user.:name.ok"
+	})
+
+	handle, ok := router.LookupPattern("user.*.>", 1)
+	assert.True(t, ok)
+	handle(nil, nil, nil)
+	assert.Equal(t, "user.*.>", called)
+
+	handle, ok = router.LookupPattern("user.:name.ok", 2)
+	assert.True(t, ok)
+	handle(nil, nil, nil)
+	assert.Equal(t, "user.:name.ok", called)
+
+	// Subjects and patterns on other ranks do not match
+	_, ok = router.LookupPattern("user.gopher.ok", 2)
+	assert.False(t, ok)
+	_, ok = router.LookupPattern("user.:id.ok", 2)
+	assert.False(t, ok)
+	_, ok = router.LookupPattern("user.*.>", 2)
+	assert.False(t, ok)
+}
+
+func TestRouterNotFoundHandler(t *testing.T) {
+	router := New()
+	router.Handle("user.:name", 1, func(_ SubjectMsg, _ Params, _ interface{}) {})
+
+	var (
+		subject string
+		got     interface{}
+	)
+	router.NotFoundHandler = func(msg SubjectMsg, payload interface{}) {
+		subject = msg.GetSubject()
+		got = payload
+	}
+
+	err := router.ServeNATSWithPayload(NewMessage("order.42"), "payload")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, "order.42", subject)
+	assert.Equal(t, "payload", got)
+
+	err = router.ServeNATS(NewMessage("order.43"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, "order.43", subject)
+	assert.Nil(t, got)
+}
+
+func BenchmarkAllowedManyRanks(b *testing.B) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	for rank := 255; rank > 127; rank-- {
+		router.Handle("path.foo.>", rank, handlerFunc)
+	}
+
+	b.Run("Global", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = router.allowed("*", 1)
+		}
+	})
+	b.Run("Path", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = router.allowed("path.foo.bar", 1)
+		}
+	})
+}
+
+func TestRouterSetEnabled(t *testing.T) {
+	router := New()
+
+	var (
+		wg     sync.WaitGroup
+		result string
+	)
+	router.Handle("ROUTING.v2.FEEDBACK.>", 1, func(_ SubjectMsg, _ Params, _ interface{}) {
+		defer wg.Done()
+		result = "ROUTING.v2.FEEDBACK.>"
+	})
+	router.Handle("ROUTING.v2.>", 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		defer wg.Done()
+		result = "ROUTING.v2.>"
+	})
+
+	serve := func() error {
+		wg.Add(1)
+		err := router.ServeNATS(NewMessage("ROUTING.v2.FEEDBACK.test"))
+		if err != nil {
+			wg.Done()
+		}
+		wg.Wait()
+
+		return err
+	}
+
+	assert.True(t, router.SetEnabled("ROUTING.v2.FEEDBACK.>", 1, false))
+	assert.NoError(t, serve())
+	assert.Equal(t, "ROUTING.v2.>", result)
+	handle, _, _ := router.Lookup("ROUTING.v2.FEEDBACK.test", 1)
+	assert.Nil(t, handle)
+
+	assert.True(t, router.SetEnabled("ROUTING.v2.>", 2, false))
+	assert.ErrorIs(t, serve(), ErrNotFound)
+
+	assert.True(t, router.SetEnabled("ROUTING.v2.FEEDBACK.>", 1, true))
+	assert.NoError(t, serve())
+	assert.Equal(t, "ROUTING.v2.FEEDBACK.>", result)
+
+	assert.False(t, router.SetEnabled("ROUTING.v3.>", 1, false))
+}
+
+func TestRouterOnSlow(t *testing.T) {
+	router := New()
+
+	var (
+		wg   sync.WaitGroup
+		slow []string
+	)
+	router.SlowThreshold = 10 * time.Millisecond
+	router.OnSlow = func(pattern string, rank int, d time.Duration) {
+		defer wg.Done()
+		assert.GreaterOrEqual(t, d, router.SlowThreshold)
+		slow = append(slow, fmt.Sprintf("%s@%d", pattern, rank))
+	}
+	router.HandleInline("fast", 1, func(_ SubjectMsg, _ Params, _ interface{}) {})
+	router.Handle("slow.*", 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		time.Sleep(20 * time.Millisecond)
+	})
+
+	wg.Add(1)
+	assert.NoError(t, router.ServeNATS(NewMessage("fast")))
+	assert.NoError(t, router.ServeNATS(NewMessage("slow.1")))
+	wg.Wait()
+	assert.Equal(t, []string{"slow.*@2"}, slow)
+}
+
+func TestRouterServeNATSWithProvider(t *testing.T) {
+	router := New()
+
+	var (
+		wg  sync.WaitGroup
+		got interface{}
+	)
+	router.Handle("user.*", 2, func(_ SubjectMsg, _ Params, payload interface{}) {
+		defer wg.Done()
+		got = payload
+	})
+
+	provided := 0
+	provide := func(pattern string, rank int) interface{} {
+		provided++
+
+		return fmt.Sprintf("%s@%d", pattern, rank)
+	}
+
+	wg.Add(1)
+	assert.NoError(t, router.ServeNATSWithProvider(NewMessage("user.gopher"), provide))
+	wg.Wait()
+	assert.Equal(t, "user.*@2", got)
+
+	assert.ErrorIs(t, router.ServeNATSWithProvider(NewMessage("order.42"), provide), ErrNotFound)
+	assert.Equal(t, 1, provided)
+}
+
+type deadlineMsg struct {
+	Msg
+	deadline time.Time
+}
+
+func (m *deadlineMsg) Deadline() (time.Time, bool) {
+	return m.deadline, !m.deadline.IsZero()
+}
+
+func TestRouterDeadline(t *testing.T) {
+	router := New()
+
+	routed := 0
+	router.HandleInline("user.:name", 1, func(_ SubjectMsg, _ Params, _ interface{}) {
+		routed++
+	})
+	var expired interface{}
+	router.ExpiredHandler = func(_ SubjectMsg, payload interface{}) {
+		expired = payload
+	}
+
+	msg := &deadlineMsg{Msg: Msg{sub: "user.gopher"}, deadline: time.Now().Add(-time.Second)}
+	assert.ErrorIs(t, router.ServeNATSWithPayload(msg, "stale"), ErrExpired)
+	assert.Equal(t, "stale", expired)
+	assert.Equal(t, 0, routed)
+
+	msg.deadline = time.Now().Add(time.Minute)
+	assert.NoError(t, router.ServeNATS(msg))
+	msg.deadline = time.Time{}
+	assert.NoError(t, router.ServeNATS(msg))
+	assert.Equal(t, 2, routed)
+}
+
+func TestRouterOrderingKey(t *testing.T) {
+	router := New()
+	router.Workers = 4
+	router.OrderingKey = func(msg SubjectMsg) string {
+		return Split(msg.GetSubject())[1]
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		got = map[string][]string{}
+	)
+	router.Handle("order.:id.:seq", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		got[ps.ByName("id")] = append(got[ps.ByName("id")], ps.ByName("seq"))
+	})
+
+	want := map[string][]string{}
+	for seq := 0; seq < 50; seq++ {
+		for _, id := range []string{"a", "b", "c"} {
+			wg.Add(1)
+			assert.NoError(t, router.ServeNATS(NewMessage(Join("order", id, fmt.Sprint(seq)))))
+			want[id] = append(want[id], fmt.Sprint(seq))
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, want, got)
+	assert.Len(t, router.workers, 4)
+}
+
+func TestRouterDryRun(t *testing.T) {
+	router := New()
+	router.Handle("ROUTING.v2.FEEDBACK.>", 1, func(_ SubjectMsg, _ Params, _ interface{}) {
+		t.Fatal("handler must not be called")
+	})
+	router.Handle("ROUTING.v2.:context.>", 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		t.Fatal("handler must not be called")
+	})
+
+	assert.Equal(t, map[string]MatchResult{
+		"ROUTING.v2.FEEDBACK.test": {
+			Pattern: "ROUTING.v2.FEEDBACK.>",
+			Path:    "ROUTING.v2.FEEDBACK.*>",
+			Rank:    1,
+			Params:  Params{{">", ".test"}},
+			Found:   true,
+		},
+		"ROUTING.v2.HR.test": {
+			Pattern: "ROUTING.v2.:context.>",
+			Path:    "ROUTING.v2.:context.*>",
+			Rank:    2,
+			Params:  Params{{"context", "HR"}, {">", ".test"}},
+			Found:   true,
+		},
+		"ROUTING.v1.HR.test": {},
+	}, router.DryRun([]string{
+		"ROUTING.v2.FEEDBACK.test",
+		"ROUTING.v2.HR.test",
+		"ROUTING.v1.HR.test",
+	}))
+}
+
+func TestRouterNotFoundError(t *testing.T) {
+	router := New()
+	assert.EqualError(t, router.ServeNATS(NewMessage("order.42")), "404 NotFound")
+
+	errUnknown := errors.New("404 unknown subject")
+	router.NotFoundError = errUnknown
+	err := router.ServeNATS(NewMessage("order.42"))
+	assert.EqualError(t, err, "404 unknown subject")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, err, errUnknown)
+}
+
+func TestRouterSwap(t *testing.T) {
+	var (
+		wg     sync.WaitGroup
+		result string
+	)
+	handle := func(name string) Handle {
+		return func(_ SubjectMsg, _ Params, _ interface{}) {
+			defer wg.Done()
+			result = name
+		}
+	}
+
+	router := New()
+	router.Handle("user.:name", 1, handle("old"))
+
+	table := New()
+	table.Handle("user.:name.:action.>", 2, handle("new"))
+	table.Handle("user.:name", 3, handle("new"))
+	router.Swap(table)
+
+	assert.Equal(t, []int{2, 3}, router.Ranks())
+	assert.Equal(t, uint16(3), router.ParamsPoolStats().MaxParams)
+
+	wg.Add(1)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	wg.Wait()
+	assert.Equal(t, "new", result)
+
+	wg.Add(1)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping.now")))
+	wg.Wait()
+	_, ps, _ := router.Lookup("user.gopher.ping.now", 2)
+	assert.Equal(t, "ping", ps.ByName("action"))
+
+	// The routing tables are copied
+	router.Handle("group.:name", 3, handle("group"))
+	assert.True(t, router.Remove("user.:name", 3))
+	assert.Len(t, table.Routes(), 2)
+	handle3, _, _ := table.Lookup("user.gopher", 3)
+	assert.NotNil(t, handle3)
+	handle3, _, _ = table.Lookup("group.admins", 3)
+	assert.Nil(t, handle3)
+	table.Handle("team.:name", 2, handle("team"))
+	assert.Len(t, router.Routes(), 2)
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("team.gophers")), ErrNotFound)
+}
+
+func TestRouterRoutes(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.Handle("b.>", 2, handlerFunc)
+	router.Handle("c.*", 1, handlerFunc)
+	router.Handle("a.>", 2, handlerFunc)
+
+	assert.Equal(t, []RouteInfo{
+		{Pattern: "b.>", Path: "b.*>", Rank: 2},
+		{Pattern: "c.*", Path: "c.:p1", Rank: 1},
+		{Pattern: "a.>", Path: "a.*>", Rank: 2},
+	}, router.RoutesInOrder())
+	assert.Equal(t, []RouteInfo{
+		{Pattern: "c.*", Path: "c.:p1", Rank: 1},
+		{Pattern: "a.>", Path: "a.*>", Rank: 2},
+		{Pattern: "b.>", Path: "b.*>", Rank: 2},
+	}, router.Routes())
+}
+
+func TestRouterOnChange(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	changes := 0
+	router.OnChange = func() {
+		changes++
+		// The router must not be locked
+		_ = router.Routes()
+	}
+
+	router.Handle("a.>", 1, handlerFunc)
+	router.HandleInline("b.>", 1, handlerFunc)
+	assert.Equal(t, 2, changes)
+	assert.True(t, router.SetEnabled("a.>", 1, false))
+	assert.False(t, router.SetEnabled("c.>", 1, false))
+	assert.Equal(t, 3, changes)
+	router.Swap(New())
+	assert.Equal(t, 4, changes)
+	assert.Error(t, router.HandleE("a.>", 0, handlerFunc))
+	assert.Equal(t, 4, changes)
+}
+
+func TestRouterPanicHandlerWithStack(t *testing.T) {
+	router := New()
+	router.HandleInline("user.:name", 1, func(_ SubjectMsg, _ Params, _ interface{}) {
+		panic("boom")
+	})
+
+	var (
+		recovered interface{}
+		stack     []byte
+	)
+	router.PanicHandler = func(SubjectMsg, interface{}) {
+		t.Fatal("PanicHandlerWithStack must take precedence")
+	}
+	router.PanicHandlerWithStack = func(_ SubjectMsg, rcv interface{}, st []byte) {
+		recovered, stack = rcv, st
+	}
+
+	assert.NotPanics(t, func() {
+		_ = router.ServeNATS(NewMessage("user.gopher"))
+	})
+	assert.Equal(t, "boom", recovered)
+	assert.Contains(t, string(stack), "TestRouterPanicHandlerWithStack")
+}
+
+func TestRouterPanicDiscardsParams(t *testing.T) {
+	router := New()
+
+	var (
+		wg       sync.WaitGroup
+		retained Params
+	)
+	router.PanicHandler = func(SubjectMsg, interface{}) {
+		wg.Done()
+	}
+	router.Handle("user.:name", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		defer wg.Done()
+		if ps.ByName("name") == "panic" {
+			retained = ps
+			panic("boom")
+		}
+		assert.Equal(t, "gopher", ps.ByName("name"))
+	})
+
+	// Done by both the handler and the PanicHandler
+	wg.Add(2)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.panic")))
+	wg.Wait()
+
+	wg.Add(1)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	wg.Wait()
+	assert.Equal(t, "panic", retained.ByName("name"))
+}
+
+func TestRouterAuthorize(t *testing.T) {
+	router := New()
+
+	routed := 0
+	router.HandleInline("tenant.:id.>", 1, func(_ SubjectMsg, _ Params, _ interface{}) {
+		routed++
+	})
+	router.Authorize = func(subject string, _ SubjectMsg) bool {
+		return !strings.HasPrefix(subject, "tenant.other.")
+	}
+	var rejected string
+	router.UnauthorizedHandler = func(msg SubjectMsg, _ interface{}) {
+		rejected = msg.GetSubject()
+	}
+
+	assert.NoError(t, router.ServeNATS(NewMessage("tenant.mine.orders")))
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("tenant.other.orders")), ErrUnauthorized)
+	assert.Equal(t, 1, routed)
+	assert.Equal(t, "tenant.other.orders", rejected)
+}
+
+func TestRouterWarnOnRankShadow(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	router := New()
+	router.WarnOnRankShadow = true
+	assert.NoError(t, router.HandleE("ROUTING.v2.>", 1, handlerFunc))
+	assert.NoError(t, router.HandleE("ROUTING.:version.>", 2, handlerFunc))
+	assert.EqualError(t, router.HandleE("ROUTING.v2.>", 2, handlerFunc),
+		"path 'ROUTING.v2.>' on rank 2 shadows or is shadowed by 'ROUTING.v2.>' on rank 1")
+	assert.EqualError(t, router.HandleE("ROUTING.*.>", 3, handlerFunc),
+		"path 'ROUTING.*.>' on rank 3 shadows or is shadowed by 'ROUTING.:version.>' on rank 2")
+
+	// Rerank checks the new rank too, leaving the route in place
+	router.WarnOnRankShadow = false
+	assert.NoError(t, router.HandleE("ROUTING.v3.>", 3, handlerFunc))
+	assert.NoError(t, router.HandleE("ROUTING.v3.>", 4, handlerFunc))
+	router.WarnOnRankShadow = true
+	assert.PanicsWithValue(t, "path 'ROUTING.v3.>' on rank 5 shadows or is shadowed by 'ROUTING.v3.>' on rank 3",
+		func() { router.Rerank("ROUTING.v3.>", 4, 5) })
+	assert.Contains(t, router.Routes(), RouteInfo{Pattern: "ROUTING.v3.>", Path: "ROUTING.v3.*>", Rank: 4})
+	assert.True(t, router.Remove("ROUTING.v3.>", 3))
+	assert.True(t, router.Rerank("ROUTING.v3.>", 4, 5))
+
+	router = New()
+	assert.NoError(t, router.HandleE("ROUTING.v2.>", 1, handlerFunc))
+	assert.NoError(t, router.HandleE("ROUTING.v2.>", 2, handlerFunc))
+}
+
+func TestRouterRerank(t *testing.T) {
+	router := New()
+	changes := 0
+	router.OnChange = func() { changes++ }
+
+	var got []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	record := func(name string) Handle {
+		return func(_ SubjectMsg, _ Params, _ interface{}) {
+			defer wg.Done()
+			mu.Lock()
+			got = append(got, name)
+			mu.Unlock()
+		}
+	}
+	router.Handle("user.*.>", 1, record("wildcard"))
+	router.Handle("user.gopher.ping", 2, record("ping"))
+	router.Handle("other", 2, record("other"))
+	router.SetEnabled("other", 2, false)
+	changes = 0
+
+	serve := func(subject string) string {
+		got = nil
+		wg.Add(1)
+		assert.NoError(t, router.ServeNATS(NewMessage(subject)))
+		wg.Wait()
+
+		return got[0]
+	}
+	assert.Equal(t, "wildcard", serve("user.gopher.ping"))
+
+	assert.True(t, router.Rerank("user.*.>", 1, 3))
+	assert.Equal(t, 1, changes)
+	assert.Equal(t, []int{2, 3}, router.Ranks())
+	assert.Equal(t, "ping", serve("user.gopher.ping"))
+	assert.Equal(t, "wildcard", serve("user.gopher.pong"))
+	assert.Contains(t, router.Routes(), RouteInfo{Pattern: "user.*.>", Path: "user.:p1.*>", Rank: 3})
+
+	// Other routes of the old rank keep their state
+	assert.True(t, router.Rerank("user.gopher.ping", 2, 1))
+	_, found := router.LookupPattern("other", 2)
+	assert.True(t, found)
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("other")), ErrNotFound)
+
+	assert.False(t, router.Rerank("user.*.>", 1, 2))
+	assert.False(t, router.Rerank("missing", 3, 2))
+	assert.True(t, router.Rerank("user.*.>", 3, 3))
+	assert.Equal(t, 2, changes)
+
+	// A conflict leaves the routes untouched
+	router.Handle("user.:name", 4, record("name"))
+	assert.Panics(t, func() { router.Rerank("user.gopher.ping", 1, 4) })
+	_, found = router.LookupPattern("user.gopher.ping", 1)
+	assert.True(t, found)
+}
+
+type dataMsg struct {
+	replyMsg
+	data   []byte
+	header map[string]string
+}
+
+func (m *dataMsg) GetData() []byte {
+	return m.data
+}
+
+func (m *dataMsg) GetHeader(key string) string {
+	return m.header[key]
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(strings.ToUpper(fmt.Sprint(v))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = strings.ToLower(string(data))
+
+	return nil
+}
+
+func TestRouterCodec(t *testing.T) {
+	type user struct {
+		Name string `json:"name"`
+	}
+
+	router := New()
+	var mu sync.Mutex
+	var errs []error
+	router.ErrorHandler = func(_ SubjectMsg, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+	router.RegisterCodec("text/upper", upperCodec{})
+
+	var wg sync.WaitGroup
+	router.HandleDecoded("user.json", 1, func() interface{} { return new(user) }, func(msg SubjectMsg, _ Params, v interface{}) {
+		defer wg.Done()
+		u := v.(*user)
+		assert.Equal(t, "gopher", u.Name)
+		assert.NoError(t, router.Respond(msg, u))
+	})
+	router.HandleDecoded("user.text", 1, func() interface{} { return new(string) }, func(msg SubjectMsg, _ Params, v interface{}) {
+		defer wg.Done()
+		assert.Equal(t, "gopher", *v.(*string))
+		assert.NoError(t, router.Respond(msg, *v.(*string)))
+	})
+
+	// JSON is used by default
+	wg.Add(1)
+	msg := &dataMsg{replyMsg: replyMsg{Msg: Msg{sub: "user.json"}}, data: []byte(`{"name":"gopher"}`)}
+	assert.NoError(t, router.ServeNATS(msg))
+	wg.Wait()
+	assert.Equal(t, `{"name":"gopher"}`, string(msg.reply))
+
+	// The content type header selects the codec
+	wg.Add(1)
+	msg = &dataMsg{
+		replyMsg: replyMsg{Msg: Msg{sub: "user.text"}},
+		data:     []byte("GOPHER"),
+		header:   map[string]string{ContentTypeHeader: "Text/Upper; charset=utf-8"},
+	}
+	assert.NoError(t, router.ServeNATS(msg))
+	wg.Wait()
+	assert.Equal(t, "GOPHER", string(msg.reply))
+
+	// *nats.Msg headers are supported
+	natsMsg := &nats.Msg{Subject: "user.json", Data: []byte(`{"name":"gopher"}`), Header: nats.Header{}}
+	natsMsg.Header.Set(ContentTypeHeader, "application/xml")
+	var u user
+	assert.ErrorIs(t, router.Decode(NewNatsMsg(natsMsg), &u), ErrUnknownContentType)
+	natsMsg.Header.Set(ContentTypeHeader, ContentTypeJSON)
+	assert.NoError(t, router.Decode(NewNatsMsg(natsMsg), &u))
+	assert.Equal(t, "gopher", u.Name)
+
+	// Messages which cannot be decoded do not reach the handle
+	assert.NoError(t, router.ServeNATS(&dataMsg{replyMsg: replyMsg{Msg: Msg{sub: "user.json"}}, data: []byte("{")}))
+	assert.NoError(t, router.ServeNATS(NewMessage("user.json")))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(errs) == 2
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.ErrorIs(t, errors.Join(errs...), ErrNoData)
+	mu.Unlock()
+
+	router.DefaultContentType = "text/upper"
+	c, err := router.Codec("")
+	assert.NoError(t, err)
+	assert.Equal(t, upperCodec{}, c)
+}
+
+func TestRouterMatchAll(t *testing.T) {
+	router := New()
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router.Handle("user.gopher.ping", 1, handlerFunc)
+	router.Handle("user.*.ping", 2, handlerFunc)
+	router.Handle("user.>", 3, handlerFunc)
+	router.Handle("user.:name.pong", 4, handlerFunc)
+	router.Handle("user.*.*", 5, handlerFunc)
+	router.SetEnabled("user.*.*", 5, false)
+
+	matches := router.MatchAll("user.gopher.ping")
+	assert.Len(t, matches, 3)
+	for i := range matches {
+		assert.NotNil(t, matches[i].Handle)
+		matches[i].Handle = nil
+	}
+	assert.Equal(t, []Match{
+		{Pattern: "user.gopher.ping", Rank: 1, Params: nil},
+		{Pattern: "user.*.ping", Rank: 2, Params: Params{{"p1", "gopher"}}},
+		{Pattern: "user.>", Rank: 3, Params: Params{{">", ".gopher.ping"}}},
+	}, matches)
+
+	// Params are independent copies
+	matches[1].Params[0].Value = "changed"
+	assert.Equal(t, "gopher", router.MatchAll("user.gopher.ping")[1].Params[0].Value)
+
+	assert.Empty(t, router.MatchAll("group.gopher"))
+}
+
+func TestRouterMaxSubjectLen(t *testing.T) {
+	router := New()
+	notFound := 0
+	router.NotFoundHandler = func(SubjectMsg, interface{}) { notFound++ }
+	done := make(chan struct{}, 1)
+	router.Handle("user.>", 1, func(_ SubjectMsg, _ Params, _ interface{}) { done <- struct{}{} })
+
+	long := "user." + strings.Repeat("a", 64)
+	assert.NoError(t, router.ServeNATS(NewMessage(long)))
+	<-done
+
+	router.MaxSubjectLen = len(long) - 1
+	assert.ErrorIs(t, router.ServeNATS(NewMessage(long)), ErrSubjectTooLong)
+	assert.Equal(t, 0, notFound)
+
+	router.MaxSubjectLen = len(long)
+	assert.NoError(t, router.ServeNATS(NewMessage(long)))
+	<-done
+}
+
+func TestRouterValidate(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.:name.>", 1, handlerFunc)
+	router.Handle("user.*.ping", 2, handlerFunc)
+	assert.NoError(t, router.Validate())
+
+	router.Handle("user.a b", 3, handlerFunc)
+	router.Handle("group..ping", 2, handlerFunc)
+	err := router.Validate()
+	assert.EqualError(t, err, "route 'user.a b' on rank 3: invalid character ' ' in token 'a b' of pattern 'user.a b'\n"+
+		"route 'group..ping' on rank 2: empty token 2 in pattern 'group..ping'")
+}
+
+type headerMsg struct {
+	Msg
+	header map[string][]string
+}
+
+func (m *headerMsg) Headers() map[string][]string {
+	return m.header
+}
+
+func TestParamsFromHeaders(t *testing.T) {
+	var ps Params
+	natsMsg := &nats.Msg{Subject: "user.gopher", Header: nats.Header{}}
+	natsMsg.Header.Set("Trace-Id", "42")
+	assert.Equal(t, map[string][]string{"Trace-Id": {"42"}}, ps.FromHeaders(NewNatsMsg(natsMsg)))
+
+	msg := &headerMsg{Msg: Msg{sub: "user.gopher"}, header: map[string][]string{"Trace-Id": {"43"}}}
+	assert.Equal(t, map[string][]string{"Trace-Id": {"43"}}, ps.FromHeaders(msg))
+
+	assert.Nil(t, ps.FromHeaders(NewMessage("user.gopher")))
+}
+
+func TestRouterLookupCache(t *testing.T) {
+	router := New()
+	router.LookupCacheSize = 2
+
+	var mu sync.Mutex
+	var got []string
+	var wg sync.WaitGroup
+	record := func(name string) Handle {
+		return func(_ SubjectMsg, ps Params, _ interface{}) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, name+" "+ps.String())
+		}
+	}
+	serve := func(subject string) string {
+		got = nil
+		wg.Add(1)
+		assert.NoError(t, router.ServeNATS(NewMessage(subject)))
+		wg.Wait()
+
+		return got[0]
+	}
+	router.Handle("user.:name.>", 2, record("user"))
+
+	assert.Equal(t, "user name=gopher, >=.ping", serve("user.gopher.ping"))
+	assert.Equal(t, "user name=gopher, >=.ping", serve("user.gopher.ping"))
+	assert.Equal(t, "user name=other, >=.ping", serve("user.other.ping"))
+	assert.Len(t, router.lookupCache.entries, 2)
+	serve("user.third.ping")
+	assert.Len(t, router.lookupCache.entries, 2)
+	assert.NotContains(t, router.lookupCache.entries, "user.gopher.ping")
+
+	// Any table change drops the cache
+	router.Handle("user.gopher.>", 1, record("gopher"))
+	assert.Empty(t, router.lookupCache.entries)
+	assert.Equal(t, "gopher >=.ping", serve("user.gopher.ping"))
+	router.SetEnabled("user.gopher.>", 1, false)
+	assert.Equal(t, "user name=gopher, >=.ping", serve("user.gopher.ping"))
+}
+
+func BenchmarkLookupCache(b *testing.B) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	// A small hot set of subjects matching the last rank, and a long tail
+	subjects := make([]string, 0, 1000)
+	for i := 0; i < cap(subjects); i++ {
+		if i%10 != 0 {
+			subjects = append(subjects, fmt.Sprintf("svc.hot.%d.ping", i%8))
+		} else {
+			subjects = append(subjects, fmt.Sprintf("svc.cold.%d.ping", i))
+		}
+	}
+
+	for _, size := range []int{0, 64} {
+		router := New()
+		router.LookupCacheSize = size
+		for rank := 1; rank <= 32; rank++ {
+			router.Handle(fmt.Sprintf("svc.rank%d.:id.>", rank), rank, handlerFunc)
+		}
+		router.Handle("svc.*.:id.>", 33, handlerFunc)
+
+		b.Run(fmt.Sprintf("Size%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, ps, _, _ := router.match(subjects[i%len(subjects)])
+				router.putParams(ps)
+			}
+		})
+	}
+}
+
+func TestRouterSimulateLoad(t *testing.T) {
+	router := New()
+	called := false
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) { called = true }
+	router.Handle("user.gopher.>", 1, handlerFunc)
+	router.Handle("user.:name.>", 2, handlerFunc)
+
+	report := router.SimulateLoad([]string{"user.gopher.ping", "user.other.ping", "user.third.ping", "group"}, 5)
+	assert.False(t, called)
+	assert.Equal(t, 20, report.Total)
+	assert.Equal(t, 5, report.Misses)
+	assert.Equal(t, map[RouteInfo]int{
+		{Pattern: "user.gopher.>", Path: "user.gopher.*>", Rank: 1}: 5,
+		{Pattern: "user.:name.>", Path: "user.:name.*>", Rank: 2}:   10,
+	}, report.Hits)
+	assert.Positive(t, report.AvgLatency)
+
+	assert.Equal(t, LoadReport{Hits: map[RouteInfo]int{}}, router.SimulateLoad(nil, 3))
+}
+
+func TestRouterMsgHandler(t *testing.T) {
+	router := New()
+	done := make(chan Params, 1)
+	router.Handle("user.:name", 1, func(_ SubjectMsg, ps Params, _ interface{}) { done <- ps })
+
+	var errs []error
+	router.ErrorHandler = func(_ SubjectMsg, err error) { errs = append(errs, err) }
+	notFound := 0
+
+	var handler nats.MsgHandler = router.MsgHandler()
+	handler(&nats.Msg{Subject: "user.gopher"})
+	assert.Equal(t, "gopher", (<-done).ByName("name"))
+
+	handler(&nats.Msg{Subject: "group.gopher"})
+	router.NotFoundHandler = func(SubjectMsg, interface{}) { notFound++ }
+	handler(&nats.Msg{Subject: "group.gopher"})
+	router.MaxSubjectLen = 4
+	handler(&nats.Msg{Subject: "user.gopher"})
+
+	assert.Equal(t, 1, notFound)
+	assert.Len(t, errs, 2)
+	assert.ErrorIs(t, errs[0], ErrNotFound)
+	assert.ErrorIs(t, errs[1], ErrSubjectTooLong)
+}
+
+func TestRouterServeRank(t *testing.T) {
+	router := New()
+	done := make(chan string, 1)
+	router.Handle("user.gopher.>", 1, func(_ SubjectMsg, _ Params, payload interface{}) {
+		done <- "gopher " + payload.(string)
+	})
+	router.Handle("user.:name.>", 2, func(_ SubjectMsg, ps Params, payload interface{}) {
+		done <- ps.ByName("name") + " " + payload.(string)
+	})
+	notFound := 0
+	router.NotFoundHandler = func(SubjectMsg, interface{}) { notFound++ }
+
+	assert.NoError(t, router.ServeRank(2, NewMessage("user.gopher.ping"), "rank 2"))
+	assert.Equal(t, "gopher rank 2", <-done)
+	assert.NoError(t, router.ServeRank(1, NewMessage("user.gopher.ping"), "rank 1"))
+	assert.Equal(t, "gopher rank 1", <-done)
+
+	assert.ErrorIs(t, router.ServeRank(1, NewMessage("user.other.ping"), nil), ErrNotFound)
+	assert.ErrorIs(t, router.ServeRank(3, NewMessage("user.other.ping"), nil), ErrNotFound)
+	assert.Equal(t, 2, notFound)
+
+	router.SetEnabled("user.:name.>", 2, false)
+	assert.ErrorIs(t, router.ServeRank(2, NewMessage("user.other.ping"), nil), ErrNotFound)
+
+	// FallbackRank only tries the fallback routes
+	assert.ErrorIs(t, router.ServeRank(FallbackRank, NewMessage("user.gopher.ping"), nil), ErrNotFound)
+	router.HandleFallback("user.>", func(_ SubjectMsg, _ Params, payload interface{}) {
+		done <- "fallback " + payload.(string)
+	})
+	assert.NoError(t, router.ServeRank(FallbackRank, NewMessage("user.gopher.ping"), "rank 0"))
+	assert.Equal(t, "fallback rank 0", <-done)
+	assert.Equal(t, 4, notFound)
+
+	assert.ErrorIs(t, router.ServeRank(-1, NewMessage("user.gopher.ping"), nil), ErrUnknownRank)
+	assert.ErrorIs(t, router.ServeRank(256, NewMessage("user.gopher.ping"), nil), ErrUnknownRank)
+	assert.Equal(t, 4, notFound)
+}
+
+func TestRouterRewrite(t *testing.T) {
+	router := New()
+	router.Rewrite = func(subject string) string {
+		if strings.HasPrefix(subject, "v1.") {
+			return "v2." + subject[len("v1."):]
+		}
+
+		return subject
+	}
+	done := make(chan string, 1)
+	router.Handle("v2.:name", 1, func(msg SubjectMsg, ps Params, _ interface{}) {
+		done <- msg.GetSubject() + " " + ps.ByName("name")
+	})
+
+	assert.NoError(t, router.ServeNATS(NewMessage("v1.foo")))
+	assert.Equal(t, "v1.foo foo", <-done)
+	assert.NoError(t, router.ServeNATS(NewMessage("v2.bar")))
+	assert.Equal(t, "v2.bar bar", <-done)
+	assert.True(t, router.DryRun([]string{"v1.foo"})["v1.foo"].Found)
+}
+
+func TestRouterSubjectFunc(t *testing.T) {
+	router := New()
+	router.SubjectFunc = func(msg SubjectMsg) string {
+		if m, ok := msg.GetMsg().(*nats.Msg); ok && m.Header.Get("Route") != "" {
+			return m.Header.Get("Route")
+		}
+
+		return msg.GetSubject()
+	}
+	router.Rewrite = strings.ToLower
+	router.MaxSubjectLen = 16
+	done := make(chan string, 1)
+	router.Handle("user.:name", 1, func(msg SubjectMsg, ps Params, _ interface{}) {
+		done <- msg.GetSubject() + " " + ps.ByName("name")
+	})
+
+	routed := &nats.Msg{Subject: "inbox.1", Header: nats.Header{"Route": []string{"USER.Gopher"}}}
+	assert.NoError(t, router.ServeNATS(NewNatsMsg(routed)))
+	assert.Equal(t, "inbox.1 gopher", <-done)
+
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gordon")))
+	assert.Equal(t, "user.gordon gordon", <-done)
+
+	routed.Header.Set("Route", "user.someone-with-a-long-name")
+	assert.ErrorIs(t, router.ServeNATS(NewNatsMsg(routed)), ErrSubjectTooLong)
+}
+
+func TestRouterServeNATSCount(t *testing.T) {
+	router := New()
+	done := make(chan struct{}, 1)
+	router.Handle("user.:name", 1, func(_ SubjectMsg, _ Params, _ interface{}) { done <- struct{}{} })
+
+	n, err := router.ServeNATSCount(NewMessage("user.gopher"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	<-done
+
+	n, err = router.ServeNATSCount(NewMessage("group.gopher"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, 0, n)
+}
+
+func BenchmarkSaveMatchedRoutePathStatic(b *testing.B) {
+	router := New()
+	router.SaveMatchedRoutePath = true
+	router.Handle("user.gopher.ping", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		if ps.MatchedRoutePath() == "" {
+			b.Fatal("missing matched route path")
+		}
+	})
+	router.Handle("user.:name.pong", 2, func(_ SubjectMsg, _ Params, _ interface{}) {})
+
+	msg := NewMessage("user.gopher.ping")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handle, ps, leaf, rank := router.match("user.gopher.ping")
+		router.call(handle, msg, ps, nil, leaf, rank)
+	}
+}
+
+func TestRouterInspect(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.*.>", 2, handlerFunc)
+	router.HandleInline("user.gopher", 1, handlerFunc)
+	router.Handle("group.:name.ping", 1, handlerFunc)
+	router.SetEnabled("group.:name.ping", 1, false)
+
+	assert.Equal(t, []RouteMeta{
+		{Pattern: "user.gopher", Path: "user.gopher", Rank: 1, Enabled: true, Inline: true},
+		{Pattern: "group.:name.ping", Path: "group.:name.ping", Rank: 1, Params: []string{"name"}},
+		{Pattern: "user.*.>", Path: "user.:p1.*>", Rank: 2, CatchAll: true, Params: []string{"p1", ">"}, Enabled: true},
+	}, router.Inspect())
+
+	walked := 0
+	router.Walk(func(RouteMeta) bool {
+		walked++
+
+		return false
+	})
+	assert.Equal(t, 1, walked)
+	assert.Nil(t, New().Inspect())
+}
+
+func TestRouterPlusToken(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+
+	// '+' is a literal token by default
+	router := New()
+	router.Handle("files.+.meta", 1, handlerFunc)
+	assert.True(t, router.DryRun([]string{"files.+.meta"})["files.+.meta"].Found)
+	assert.False(t, router.DryRun([]string{"files.a.meta"})["files.a.meta"].Found)
+	assert.Panics(t, func() { router.Handle("files.:+name", 2, handlerFunc) })
+
+	router = New()
+	router.EnablePlusToken = true
+	router.Handle("files.+.meta", 1, handlerFunc)
+	router.Handle("dirs.*.+.:kind", 1, handlerFunc)
+	router.Handle("tail.+", 1, handlerFunc)
+	router.Handle("rest.+.>", 1, handlerFunc)
+
+	for subject, want := range map[string]Params{
+		"files.a.meta":        {{"p1", "a"}},
+		"files.a.b.meta":      {{"p1", "a.b"}},
+		"files.a.meta.b.meta": {{"p1", "a.meta.b"}},
+		"dirs.x.a.b.c":        {{"p1", "x"}, {"p2", "a.b"}, {"kind", "c"}},
+		"tail.a.b":            {{"p1", "a.b"}},
+		"rest.a.b.c":          {{"p1", "a"}, {">", ".b.c"}},
+	} {
+		result := router.DryRun([]string{subject})[subject]
+		assert.True(t, result.Found, subject)
+		assert.Equal(t, want, result.Params, subject)
+	}
+	for _, subject := range []string{"files.meta", "files.a.b", "dirs.x.a", "tail", "rest.a"} {
+		assert.False(t, router.DryRun([]string{subject})[subject].Found, subject)
+	}
+
+	assert.Equal(t, []string{"files.>", "dirs.*.>", "tail.>", "rest.>"}, router.Subjects())
+	assert.NoError(t, router.Validate())
+	_, found := router.LookupPattern("files.+.meta", 1)
+	assert.True(t, found)
+	assert.Equal(t, []string{"p1"}, router.Inspect()[0].Params)
+}
+
+func TestRouterLookupTSR(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.gopher", 1, handlerFunc)
+	router.Handle("user.:name.ping", 2, handlerFunc)
+	router.Handle("group.admins.", 1, handlerFunc)
+
+	assert.True(t, router.LookupTSR("user.gopher.", 1))
+	assert.True(t, router.LookupTSR("group.admins", 1))
+	assert.True(t, router.LookupTSR("user.other.ping.", 2))
+	assert.False(t, router.LookupTSR("user.gopher", 1))
+	assert.False(t, router.LookupTSR("user.gopher.", 3))
+}
+
+func TestRouterRemove(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	changes := 0
+	router.OnChange = func() { changes++ }
+	router.Handle("user.:name.ping", 1, handlerFunc)
+	router.Handle("user.:name.pong", 1, handlerFunc)
+	router.Handle("user.>", 2, handlerFunc)
+	changes = 0
+
+	assert.True(t, router.Remove("user.:name.ping", 1))
+	assert.False(t, router.Remove("user.:name.ping", 1))
+	assert.Equal(t, 1, changes)
+	assert.Equal(t, 2, router.DryRun([]string{"user.gopher.ping"})["user.gopher.ping"].Rank)
+	assert.Equal(t, 1, router.DryRun([]string{"user.gopher.pong"})["user.gopher.pong"].Rank)
+
+	assert.True(t, router.Remove("user.>", 2))
+	assert.Equal(t, []int{1}, router.Ranks())
+	assert.Equal(t, []RouteInfo{{Pattern: "user.:name.pong", Path: "user.:name.pong", Rank: 1}}, router.Routes())
+}
+
+func TestRouterRegister(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+
+	unregister, err := router.Register("user.:name", 1, handlerFunc)
+	assert.NoError(t, err)
+	assert.True(t, router.DryRun([]string{"user.gopher"})["user.gopher"].Found)
+	unregister()
+	assert.False(t, router.DryRun([]string{"user.gopher"})["user.gopher"].Found)
+
+	_, err = router.Register("user.:name", 1, nil)
+	assert.ErrorIs(t, err, ErrNilHandler)
+
+	// A stale unregister leaves a newer registration alone
+	unregister, err = router.Register("user.:name", 1, handlerFunc)
+	assert.NoError(t, err)
+	_, err = router.Register("user.:name", 1, handlerFunc)
+	assert.Error(t, err)
+	router.Remove("user.:name", 1)
+	router.Handle("user.:name", 1, handlerFunc)
+	unregister()
+	assert.True(t, router.DryRun([]string{"user.gopher"})["user.gopher"].Found)
+
+	// Reranked routes can still be unregistered
+	unregister, err = router.Register("group.*", 2, handlerFunc)
+	assert.NoError(t, err)
+	router.Rerank("group.*", 2, 3)
+	unregister()
+	assert.Equal(t, []int{1}, router.Ranks())
+}
+
+func BenchmarkConcurrentServe(b *testing.B) {
+	router := New()
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	for i := 0; i < 32; i++ {
+		router.HandleInline(fmt.Sprintf("svc%d.:id.>", i), 1+i%4, handlerFunc)
+	}
+	msgs := make([]SubjectMsg, 64)
+	for i := range msgs {
+		msgs[i] = NewMessage(fmt.Sprintf("svc%d.%d.ping", i%32, i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if err := router.ServeNATS(msgs[i%len(msgs)]); err != nil {
+				b.Error(err)
+			}
+			i++
+		}
+	})
+}
+
+func TestRouterGlobalAllowed(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.:name", 1, handlerFunc)
+	router.Handle("user.gopher.>", 2, handlerFunc)
+	router.Handle("group.>", 2, handlerFunc)
+	assert.Equal(t, "1, 2", router.allowed("*", 1))
+
+	// A failed registration does not add its rank
+	assert.Error(t, router.HandleE("a.:x:y", 3, handlerFunc))
+	assert.Error(t, router.HandleE("a.:", 4, handlerFunc))
+	assert.Equal(t, "1, 2", router.allowed("*", 1))
+	assert.Equal(t, []int{1, 2}, router.Ranks())
+
+	// Removing the last route of a rank drops the rank
+	router.Remove("user.gopher.>", 2)
+	assert.Equal(t, "1, 2", router.allowed("*", 1))
+	router.Remove("group.>", 2)
+	assert.Equal(t, "1", router.allowed("*", 1))
+	assert.Equal(t, []int{1}, router.Ranks())
+
+	router.Rerank("user.:name", 1, 5)
+	assert.Equal(t, "5", router.allowed("*", 1))
+	assert.Equal(t, []int{5}, router.Ranks())
+
+	router.Remove("user.:name", 5)
+	assert.Equal(t, "", router.allowed("*", 1))
+	assert.Empty(t, router.Ranks())
+}
+
+func TestRouterAllowedAllocs(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("path", 1, handlerFunc)
+	router.Handle("path", 2, handlerFunc)
+	router.Handle("path.foo.>", 1, handlerFunc)
+
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		_ = router.allowed("*", 1)
+	}))
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		_ = router.allowed("path.foo.bar", 2)
+	}))
+	assert.Zero(t, testing.AllocsPerRun(100, func() {
+		_ = router.allowed("missing", 1)
+	}))
+
+	// Only the list itself is allocated
+	assert.Equal(t, "1, 2", router.allowed("path", 3))
+	assert.Equal(t, 1.0, testing.AllocsPerRun(100, func() {
+		_ = router.allowed("path", 3)
+	}))
+}
+
+func TestRouterReplay(t *testing.T) {
+	router := New()
+	var got []string
+	router.HandleInline("user.:name", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		got = append(got, ps.ByName("name"))
+	})
+	var errs []error
+	router.ErrorHandler = func(_ SubjectMsg, err error) { errs = append(errs, err) }
+
+	source := func(subjects ...string) func() (SubjectMsg, bool) {
+		return func() (SubjectMsg, bool) {
+			if len(subjects) == 0 {
+				return nil, false
+			}
+			msg := NewMessage(subjects[0])
+			subjects = subjects[1:]
+
+			return msg, true
+		}
+	}
+
+	assert.NoError(t, router.Replay(context.Background(), source("user.a", "group.b", "user.c")))
+	assert.Equal(t, []string{"a", "c"}, got)
+	assert.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], ErrNotFound)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got = nil
+	router.HandleInline("stop", 1, func(_ SubjectMsg, _ Params, _ interface{}) { cancel() })
+	assert.ErrorIs(t, router.Replay(ctx, source("user.a", "stop", "user.c")), context.Canceled)
+	assert.Equal(t, []string{"a"}, got)
+}
+
+func TestRouterHandleWithConcurrency(t *testing.T) {
+	router := New()
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+		wg      sync.WaitGroup
+	)
+	router.HandleWithConcurrency("legacy.:id", 1, 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		defer wg.Done()
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	// Edge splits keep the limit on the leaf
+	router.Handle("legacy.:id.other", 1, func(_ SubjectMsg, _ Params, _ interface{}) {})
+
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, router.ServeNATS(NewMessage(fmt.Sprintf("legacy.%d", i))))
+	}
+	wg.Wait()
+	assert.Equal(t, 2, peak)
+	assert.Equal(t, 2, router.Inspect()[0].ConcurrencyLimit)
+
+	assert.Panics(t, func() { router.HandleWithConcurrency("other", 1, 0, func(_ SubjectMsg, _ Params, _ interface{}) {}) })
+}
+
+func TestRouterHandleWithConcurrencySplitInFlight(t *testing.T) {
+	router := New()
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan string, 2)
+	router.HandleWithConcurrency("a.bc", 1, 1, func(msg SubjectMsg, _ Params, _ interface{}) {
+		started <- struct{}{}
+		<-release
+		done <- msg.GetSubject()
+	})
+
+	assert.NoError(t, router.ServeNATS(NewMessage("a.bc")))
+	<-started
+	// Splits the leaf of the route being served
+	router.Handle("a.bd", 1, func(_ SubjectMsg, _ Params, _ interface{}) {})
+	close(release)
+	assert.Equal(t, "a.bc", <-done)
+
+	// The slot was released
+	assert.NoError(t, router.ServeNATS(NewMessage("a.bc")))
+	<-started
+	assert.Equal(t, "a.bc", <-done)
+	assert.Equal(t, uint64(2), router.HitCounts()["a.bc"])
+}
+
+func TestRouterLookupInfo(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.*.>", 1, handlerFunc)
+	router.Handle("group.admins", 2, handlerFunc)
+
+	info, found := router.LookupInfo("user.gopher.ping", 1)
+	assert.True(t, found)
+	assert.NotNil(t, info.Handle)
+	info.Handle = nil
+	assert.Equal(t, &MatchInfo{
+		Params:  Params{{"p1", "gopher"}, {">", ".ping"}},
+		Pattern: "user.*.>",
+		Path:    "user.:p1.*>",
+		Rank:    1,
+	}, info)
+
+	info, found = router.LookupInfo("group.admins.", 2)
+	assert.False(t, found)
+	assert.Equal(t, &MatchInfo{Rank: 2, TSR: true}, info)
+
+	info, found = router.LookupInfo("group.admins", 3)
+	assert.False(t, found)
+	assert.Equal(t, &MatchInfo{Rank: 3}, info)
+}
+
+func TestRouterHandleWithDefaultPayload(t *testing.T) {
+	type deps struct{ db string }
+
+	router := New()
+	done := make(chan interface{}, 1)
+	router.HandleWithDefaultPayload("user.:name", 1, &deps{db: "users"}, func(_ SubjectMsg, _ Params, payload interface{}) {
+		done <- payload
+	})
+	router.Handle("user.:name.ping", 1, func(_ SubjectMsg, _ Params, payload interface{}) {
+		done <- payload
+	})
+
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	assert.Equal(t, &deps{db: "users"}, <-done)
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("user.gopher"), "explicit"))
+	assert.Equal(t, "explicit", <-done)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping")))
+	assert.Nil(t, <-done)
+}
+
+func TestRouterNilMessage(t *testing.T) {
+	router := New()
+	router.Handle("user.:name", 1, func(_ SubjectMsg, _ Params, _ interface{}) {})
+	router.PanicHandler = func(SubjectMsg, interface{}) {}
+
+	assert.ErrorIs(t, router.ServeNATS(nil), ErrNilMessage)
+	assert.ErrorIs(t, router.ServeNATSWithPayload(nil, "payload"), ErrNilMessage)
+	assert.ErrorIs(t, router.ServeRank(1, nil, nil), ErrNilMessage)
+}
+
+func TestRouterServeNATSReentrant(t *testing.T) {
+	router := New()
+	router.SaveMatchedRoutePath = true
+	router.CorrelationID = func(msg SubjectMsg) string { return msg.GetSubject() }
+
+	var inner []Params
+	router.HandleInline("inner.:x.:y.:z", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		inner = append(inner, ps.SortedByKey())
+	})
+	done := make(chan Params, 1)
+	router.HandleInline("outer.:a.:b", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		before := ps.SortedByKey()
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, router.ServeNATS(NewMessage("inner.1.2."+strconv.Itoa(i))))
+		}
+		assert.Equal(t, before, ps.SortedByKey(), "nested calls do not touch the outer params")
+		done <- append(Params(nil), ps...)
+	})
+
+	assert.NoError(t, router.ServeNATS(NewMessage("outer.gopher.ping")))
+	ps := <-done
+	assert.Equal(t, "gopher", ps.ByName("a"))
+	assert.Equal(t, "ping", ps.ByName("b"))
+	assert.Equal(t, "outer.:a.:b", ps.MatchedRoutePath())
+	assert.Equal(t, "outer.gopher.ping", ps.CorrelationID())
+	if assert.Len(t, inner, 3) {
+		for i, ips := range inner {
+			assert.Equal(t, strconv.Itoa(i), ips.ByName("z"))
+			assert.Equal(t, "inner.:x.:y.:z", ips.MatchedRoutePath())
+		}
+	}
+}
+
+func TestRouterResolve(t *testing.T) {
+	router := New()
+	router.Executor = InlineExecutor
+	var calls []string
+	router.HandleWithDefaultPayload("user.:name.>", 1, "default", func(msg SubjectMsg, ps Params, payload interface{}) {
+		calls = append(calls, fmt.Sprint(msg.GetSubject(), " ", ps.ByName("name"), " ", payload))
+	})
+	var notFound int
+	router.NotFoundHandler = func(SubjectMsg, interface{}) { notFound++ }
+
+	run, ps, err := router.Resolve(NewMessage("user.gopher.ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, Params{{"name", "gopher"}, {">", ".ping"}}, ps)
+	assert.Empty(t, calls, "nothing runs until the caller does")
+
+	// The params are owned by the caller, whatever is served meanwhile
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, router.ServeRank(1, NewMessage("user.other.pong"), nil))
+	}
+	run(nil)
+	run(42)
+	assert.Equal(t, Params{{"name", "gopher"}, {">", ".ping"}}, ps)
+	assert.Equal(t, []string{"user.gopher.ping gopher default", "user.gopher.ping gopher 42"}, calls[10:])
+	assert.Equal(t, uint64(2+10), router.HitCounts()["user.:name.>"])
+
+	run, ps, err = router.Resolve(NewMessage("group.admins"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Nil(t, run)
+	assert.Nil(t, ps)
+	assert.Equal(t, 1, notFound)
+
+	_, _, err = router.Resolve(nil)
+	assert.ErrorIs(t, err, ErrNilMessage)
+}
+
+func TestRouterServeNATSAll(t *testing.T) {
+	router := New()
+	order := make(chan string, 3)
+	for _, route := range []struct {
+		path string
+		rank int
+	}{{"user.>", 1}, {"user.*.ping", 2}, {"user.gopher.ping", 3}} {
+		path := route.path
+		router.Handle(path, route.rank, func(_ SubjectMsg, _ Params, _ interface{}) {
+			order <- path
+		})
+	}
+	collect := func() []string {
+		got := make([]string, 3)
+		for i := range got {
+			got[i] = <-order
+		}
+
+		return got
+	}
+
+	n, err := router.ServeNATSAll(NewMessage("user.gopher.ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"user.>", "user.*.ping", "user.gopher.ping"}, collect())
+
+	router.HandlerOrder = func(a, b RouteMeta) bool {
+		return a.Rank > b.Rank
+	}
+	n, err = router.ServeNATSAll(NewMessage("user.gopher.ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []string{"user.gopher.ping", "user.*.ping", "user.>"}, collect())
+
+	n, err = router.ServeNATSAll(NewMessage("group.admins"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Zero(t, n)
+}
+
+func TestRouterCorrelationID(t *testing.T) {
+	router := New()
+	router.CorrelationID = func(msg SubjectMsg) string {
+		// e.g. confirm-subscription.:mongoid.:correlationid
+		tokens := Split(msg.GetSubject())
+		if len(tokens) < 3 {
+			return ""
+		}
+
+		return tokens[2]
+	}
+	router.SlowThreshold = time.Nanosecond
+	slow := make(chan string, 1)
+	router.OnSlowCorrelated = func(pattern string, _ int, _ time.Duration, correlationID string) {
+		slow <- pattern + " " + correlationID
+	}
+
+	done := make(chan Params, 1)
+	router.Handle("confirm-subscription.*.:correlationid", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		time.Sleep(time.Millisecond)
+		done <- ps
+	})
+	router.Handle("ping", 1, func(_ SubjectMsg, ps Params, _ interface{}) {
+		done <- ps
+	})
+
+	msg := NewMessage("confirm-subscription.5f1d.c0ffee")
+	assert.Equal(t, "c0ffee", router.CorrelationIDOf(msg))
+	assert.NoError(t, router.ServeNATS(msg))
+	ps := <-done
+	assert.Equal(t, "c0ffee", ps.CorrelationID())
+	assert.Equal(t, Params{{Key: "p1", Value: "5f1d"}, {Key: "correlationid", Value: "c0ffee"}}, ps.UserParams())
+	assert.Equal(t, "confirm-subscription.*.:correlationid c0ffee", <-slow)
+
+	assert.NoError(t, router.ServeNATS(NewMessage("ping")))
+	assert.Empty(t, (<-done).CorrelationID())
+	assert.Equal(t, "ping ", <-slow)
+
+	assert.Empty(t, New().CorrelationIDOf(msg))
+}
+
+func TestRouterNotFoundAsync(t *testing.T) {
+	router := New()
+	release := make(chan struct{})
+	done := make(chan struct{})
+	router.NotFoundHandler = func(SubjectMsg, interface{}) {
+		<-release
+		close(done)
+	}
+	router.NotFoundAsync = true
+
+	// Would block forever if inline
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("user.gopher")), ErrNotFound)
+	close(release)
+	<-done
+
+	panics := make(chan interface{}, 1)
+	router.PanicHandler = func(_ SubjectMsg, rcv interface{}) { panics <- rcv }
+	router.NotFoundHandler = func(SubjectMsg, interface{}) { panic("dead letter") }
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("user.gopher")), ErrNotFound)
+	assert.Equal(t, "dead letter", <-panics)
+}
+
+func TestRouterAllowedRanks(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("ROUTING.v2.users", 1, handlerFunc)
+	router.Handle("ROUTING.v2.*.get", 2, handlerFunc)
+	router.Handle("ROUTING.>", 3, handlerFunc)
+	router.Handle("ROUTING.v1.>", 4, handlerFunc)
+	router.Handle("ROUTING", 5, handlerFunc)
+
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, router.AllowedRanks("*"))
+
+	// Subject queries match exactly
+	assert.Equal(t, []int{1, 3}, router.AllowedRanks("ROUTING.v2.users"))
+	assert.Equal(t, []int{2, 3}, router.AllowedRanks("ROUTING.v2.users.get"))
+	assert.Equal(t, []int{5}, router.AllowedRanks("ROUTING"))
+	assert.Empty(t, router.AllowedRanks("BILLING"))
+
+	// Pattern queries match prefixes
+	assert.Equal(t, []int{1, 2, 3}, router.AllowedRanks("ROUTING.v2.*"))
+	assert.Equal(t, []int{1, 2, 3}, router.AllowedRanks("ROUTING.v2.>"))
+	assert.Equal(t, []int{2, 3, 4}, router.AllowedRanks("ROUTING.*.*.get"))
+	assert.Equal(t, []int{3, 4}, router.AllowedRanks("ROUTING.v1.*"))
+	assert.Equal(t, []int{1, 2, 3, 4}, router.AllowedRanks("ROUTING.>"))
+	assert.Empty(t, router.AllowedRanks("BILLING.>"))
+
+	assert.True(t, router.SetEnabled("ROUTING.>", 3, false))
+	assert.Equal(t, []int{4}, router.AllowedRanks("ROUTING.v1.*"))
+}
+
+func TestBuilder(t *testing.T) {
+	done := make(chan Params, 1)
+	router, err := NewBuilder().
+		WithPanicHandler(func(SubjectMsg, interface{}) {}).
+		WithMaxConcurrency(2).
+		SaveMatchedRoutePath().
+		With(func(r *Router) { r.NotFoundAsync = true }).
+		Handle("user.*.ping", 1, func(_ SubjectMsg, ps Params, _ interface{}) { done <- ps }).
+		Build()
+	assert.NoError(t, err)
+	assert.NotNil(t, router.PanicHandler)
+	assert.True(t, router.NotFoundAsync)
+	assert.NotNil(t, router.Executor)
+
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping")))
+	assert.Equal(t, "user.:p1.ping", (<-done).MatchedRoutePath())
+
+	// The limit is router-wide, whatever the number of routes
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	handle := func(SubjectMsg, Params, interface{}) {
+		defer wg.Done()
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		running.Add(-1)
+	}
+	builder := NewBuilder().WithMaxConcurrency(2)
+	for i := 0; i < 5; i++ {
+		builder.Handle("route."+strconv.Itoa(i), 1, handle)
+	}
+	router, err = builder.Build()
+	assert.NoError(t, err)
+	wg.Add(10)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, router.ServeNATS(NewMessage("route."+strconv.Itoa(i%5))))
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), peak.Load())
+	assert.Zero(t, router.Inspect()[0].ConcurrencyLimit)
+
+	router, err = NewBuilder().
+		WithMaxConcurrency(0).
+		Handle("user.*.ping", 0, func(SubjectMsg, Params, interface{}) {}).
+		Handle("user.*.pong", 1, nil).
+		Build()
+	assert.Nil(t, router)
+	assert.ErrorContains(t, err, "max concurrency must be > 0")
+	assert.ErrorContains(t, err, "route 'user.*.ping' on rank 0: rank must be > 0")
+	assert.ErrorIs(t, err, ErrNilHandler)
+}
+
+// fakeConn records subscriptions, failing for the subjects in fail.
+type fakeConn struct {
+	mu       sync.Mutex
+	subjects []string
+	fail     map[string]bool
+}
+
+func (c *fakeConn) Subscribe(subject string, cb nats.MsgHandler) (*nats.Subscription, error) {
+	return c.QueueSubscribe(subject, "", cb)
+}
+
+func (c *fakeConn) QueueSubscribe(subject, queue string, _ nats.MsgHandler) (*nats.Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fail[subject] {
+		return nil, errors.New("subscribe failed")
+	}
+	c.subjects = append(c.subjects, queue+":"+subject)
+
+	return &nats.Subscription{Subject: subject, Queue: queue}, nil
+}
+
+func TestRouterSubscribeLateHandle(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.:name.ping", 1, handlerFunc)
+
+	conn := &fakeConn{fail: map[string]bool{"broken": true}}
+	assert.NoError(t, router.subscribe(conn, "workers"))
+	assert.ErrorIs(t, router.subscribe(conn, "workers"), ErrSubscribed)
+	assert.Equal(t, []string{"workers:user.*.ping"}, conn.subjects)
+
+	// Late registrations are subscribed, once per subject
+	router.Handle("user.:name.pong", 1, handlerFunc)
+	router.Handle("user.:id.pong", 2, handlerFunc)
+	assert.Equal(t, []string{"workers:user.*.ping", "workers:user.*.pong"}, conn.subjects)
+
+	var failed []string
+	router.SubscribeErrorHandler = func(subject string, err error) {
+		failed = append(failed, subject)
+	}
+	router.Handle("broken", 1, handlerFunc)
+	assert.Equal(t, []string{"broken"}, failed)
+	assert.Len(t, conn.subjects, 2)
+}
+
+func TestRouterSubscribeOverlapping(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("ROUTING.v2.>", 1, handlerFunc)
+	router.Handle("ROUTING.v2.FEEDBACK.>", 2, handlerFunc)
+	router.Handle("user.*.ping", 1, handlerFunc)
+	router.Handle("user.gopher.ping", 2, handlerFunc)
+
+	conn := &fakeConn{}
+	assert.NoError(t, router.subscribe(conn, ""))
+	assert.Equal(t, []string{":ROUTING.v2.>", ":user.*.ping"}, conn.subjects)
+
+	// A late subject covering subscribed ones replaces them
+	var failed []string
+	router.SubscribeErrorHandler = func(subject string, err error) {
+		// The fake subscriptions have no connection to unsubscribe from
+		assert.ErrorIs(t, err, nats.ErrConnectionClosed)
+		failed = append(failed, subject)
+	}
+	router.Handle("ROUTING.>", 3, handlerFunc)
+	router.Handle("ROUTING.v1.*", 4, handlerFunc)
+	assert.Equal(t, []string{":ROUTING.v2.>", ":user.*.ping", ":ROUTING.>"}, conn.subjects)
+	assert.Equal(t, []string{"ROUTING.v2.>"}, failed)
+	router.subs.mu.Lock()
+	assert.Len(t, router.subs.bySubject, 2)
+	assert.Contains(t, router.subs.bySubject, "ROUTING.>")
+	assert.Contains(t, router.subs.bySubject, "user.*.ping")
+	router.subs.mu.Unlock()
+}
+
+func TestRouterSubscribeSync(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("x.>", 1, handlerFunc)
+	router.Handle("x.b", 2, handlerFunc)
+	router.Handle("y.*", 1, handlerFunc)
+
+	conn := &fakeConn{fail: map[string]bool{"z.>": true}}
+	assert.NoError(t, router.subscribe(conn, ""))
+	assert.Equal(t, []string{":x.>", ":y.*"}, conn.subjects)
+
+	var failed []string
+	router.SubscribeErrorHandler = func(subject string, err error) {
+		failed = append(failed, subject)
+	}
+	subscribed := func() []string {
+		router.subs.mu.Lock()
+		defer router.subs.mu.Unlock()
+		subjects := make([]string, 0, len(router.subs.bySubject))
+		for subject := range router.subs.bySubject {
+			subjects = append(subjects, subject)
+		}
+		sort.Strings(subjects)
+
+		return subjects
+	}
+
+	// Removed routes are unsubscribed
+	assert.True(t, router.Remove("y.*", 1))
+	assert.Equal(t, []string{"x.>"}, subscribed())
+
+	// Disabled routes are unsubscribed, uncovering the ones they covered
+	assert.True(t, router.SetEnabled("x.>", 1, false))
+	assert.Equal(t, []string{"x.b"}, subscribed())
+	assert.True(t, router.SetEnabled("x.>", 1, true))
+	assert.Equal(t, []string{"x.>"}, subscribed())
+	assert.Equal(t, []string{":x.>", ":y.*", ":x.b", ":x.>"}, conn.subjects)
+
+	// A covered subscription is kept until its covering one is subscribed
+	router.Handle("z.a", 1, handlerFunc)
+	router.Handle("z.>", 2, handlerFunc)
+	assert.Equal(t, []string{"x.>", "z.a"}, subscribed())
+	delete(conn.fail, "z.>")
+	assert.True(t, router.Remove("x.>", 1))
+	assert.Equal(t, []string{"x.b", "z.>"}, subscribed())
+
+	// The fake subscriptions have no connection to unsubscribe from
+	assert.ElementsMatch(t, []string{"y.*", "x.>", "x.b", "z.>", "z.a", "x.>"}, failed)
+}
+
+func TestRouterQueueSubscribeCovered(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("a.>", 1, handlerFunc)
+	router.Handle("a.b", 2, handlerFunc)
+	router.Handle("c.*", 2, handlerFunc)
+
+	conn := &fakeConn{}
+	subs, err := router.queueSubscribe(conn, "workers")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"workers:a.>", "workers:c.*"}, conn.subjects)
+	assert.Len(t, subs, 2)
+
+	// On error, nothing is returned
+	conn = &fakeConn{fail: map[string]bool{"c.*": true}}
+	subs, err = router.queueSubscribe(conn, "workers")
+	assert.Error(t, err)
+	assert.Nil(t, subs)
+}
+
+func TestRouterUnsubscribe(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Handle("user.:name.ping", 1, handlerFunc)
+	router.Handle("user.:name.pong", 1, handlerFunc)
+	assert.NoError(t, router.Unsubscribe())
+
+	conn := &fakeConn{}
+	assert.NoError(t, router.subscribe(conn, ""))
+
+	// The fake subscriptions have no connection to unsubscribe from
+	err := router.Unsubscribe()
+	assert.ErrorIs(t, err, nats.ErrConnectionClosed)
+	assert.EqualError(t, err, "unsubscribe 'user.*.ping': nats: connection closed\n"+
+		"unsubscribe 'user.*.pong': nats: connection closed")
+
+	// Forgotten: later routes are not subscribed, and Subscribe works again
+	router.Handle("user.:name.pang", 1, handlerFunc)
+	assert.Len(t, conn.subjects, 2)
+	assert.NoError(t, router.Unsubscribe())
+	assert.NoError(t, router.subscribe(conn, ""))
+	assert.Len(t, conn.subjects, 5)
+}
+
+func TestRouterHealthy(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	ok, reason := router.Healthy()
+	assert.False(t, ok)
+	assert.Equal(t, "no routes registered", reason)
+
+	router.Handle("user.:name.ping", 1, handlerFunc)
+	ok, reason = router.Healthy()
+	assert.True(t, ok)
+	assert.Empty(t, reason)
+
+	// The fake subscriptions have no connection, so they are not valid
+	conn := &fakeConn{fail: map[string]bool{"broken": true}}
+	assert.NoError(t, router.subscribe(conn, ""))
+	router.Handle("broken", 1, handlerFunc)
+	ok, reason = router.Healthy()
+	assert.False(t, ok)
+	assert.Equal(t, "subscription 'user.*.ping' not valid; subject 'broken' not subscribed", reason)
+	assert.Len(t, conn.subjects, 1, "Healthy does not subscribe")
+
+	assert.Error(t, router.Unsubscribe())
+	ok, _ = router.Healthy()
+	assert.True(t, ok)
+}
+
+func TestRouterExecutor(t *testing.T) {
+	router := New()
+	var tasks atomic.Int32
+	router.Executor = ExecutorFunc(func(task func()) {
+		tasks.Add(1)
+		InlineExecutor.Go(task)
+	})
+	router.NotFoundAsync = true
+	router.NotFoundHandler = func(SubjectMsg, interface{}) {}
+
+	var calls []string
+	router.Handle("user.:name", 1, func(_ SubjectMsg, ps Params, payload interface{}) {
+		calls = append(calls, fmt.Sprint(ps.ByName("name"), payload))
+	})
+	router.Handle("user.>", 2, func(_ SubjectMsg, _ Params, _ interface{}) {
+		calls = append(calls, "catch-all")
+	})
+
+	// Inline, so the handles completed on return
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("user.gordon"), 42))
+	n, err := router.ServeNATSAll(NewMessage("user.gopher"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("group.admins")), ErrNotFound)
+
+	assert.Equal(t, []string{"gopher<nil>", "gordon42", "gopher<nil>", "catch-all"}, calls)
+	assert.Equal(t, int32(4), tasks.Load())
+
+	assert.Panics(t, func() { BoundedExecutor(nil, 0) })
+}
+
+func TestParamNames(t *testing.T) {
+	assert.Equal(t, []string{"p1", "id", ">"}, ParamNames("user.*.:id.>"))
+	assert.Equal(t, []string{"p1", "p2"}, ParamNames("*.ping.*"))
+	assert.Equal(t, []string{"mongoid", "correlationid"}, ParamNames("confirm-subscription.:mongoid.:correlationid"))
+	assert.Nil(t, ParamNames("user.gopher.ping"))
+
+	// As found by the handles
+	router := New()
+	done := make(chan Params, 1)
+	router.Handle("user.*.:id.>", 1, func(_ SubjectMsg, ps Params, _ interface{}) { done <- ps })
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.42.ok")))
+	ps := <-done
+	for i, name := range ParamNames("user.*.:id.>") {
+		assert.Equal(t, name, ps[i].Key)
+	}
+}
+
+func TestRouterExtract(t *testing.T) {
+	router := New()
+	router.Handle("confirm-subscription.:mongoid.:correlationid", 1, func(SubjectMsg, Params, interface{}) {
+		t.Fatal("handle must not run")
+	})
+	router.Handle("ping", 1, func(SubjectMsg, Params, interface{}) {})
+
+	ps, ok := router.Extract("confirm-subscription.5f1d.c0ffee", 1)
+	assert.True(t, ok)
+	assert.Equal(t, Params{{Key: "mongoid", Value: "5f1d"}, {Key: "correlationid", Value: "c0ffee"}}, ps)
+
+	// Not pooled: later matches leave it untouched
+	_, _ = router.Extract("confirm-subscription.other.id", 1)
+	assert.Equal(t, "5f1d", ps.ByName("mongoid"))
+
+	ps, ok = router.Extract("ping", 1)
+	assert.True(t, ok)
+	assert.Nil(t, ps)
+
+	_, ok = router.Extract("confirm-subscription.5f1d.c0ffee", 2)
+	assert.False(t, ok)
+	_, ok = router.Extract("pong", 1)
+	assert.False(t, ok)
+}
+
+func TestRouterNumberCatchAll(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	for _, split := range []bool{false, true} {
+		router := New()
+		router.NumberCatchAll = true
+		router.SplitCatchAll = split
+		router.Handle("user.*.>", 1, handlerFunc)
+		router.Handle("group.:name.>", 2, handlerFunc)
+		router.Handle("a.>", 3, handlerFunc)
+
+		_, ps, _ := router.Lookup("user.gopher.star.ok", 1)
+		assert.Equal(t, Params{
+			{Key: "p1", Value: "gopher"},
+			{Key: ">", Value: ".star.ok"},
+			{Key: "p2", Value: "star"},
+			{Key: "p3", Value: "ok"},
+		}, ps)
+
+		// Custom names are not numbered
+		ps, _ = router.Extract("group.admins.x", 2)
+		assert.Equal(t, Params{{Key: "name", Value: "admins"}, {Key: ">", Value: ".x"}, {Key: "p1", Value: "x"}}, ps)
+
+		ps, _ = router.Extract("a.foo.c", 3)
+		assert.Equal(t, "foo", ps.ByName("p1"))
+		assert.Equal(t, "c", ps.ByName("p2"))
+		assert.Len(t, ps, 3)
+	}
+}
+
+func TestRouterExpiryFromParams(t *testing.T) {
+	router := New()
+	router.ExpiryFromParams = func(ps Params) (time.Time, bool) {
+		issuedAt, err := strconv.ParseInt(ps.ByName("iat"), 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		return time.Unix(issuedAt, 0).Add(time.Minute), true
+	}
+	expired := make(chan string, 1)
+	router.ExpiredHandler = func(msg SubjectMsg, _ interface{}) { expired <- msg.GetSubject() }
+	done := make(chan string, 1)
+	router.Handle("order.:iat.created", 1, func(msg SubjectMsg, _ Params, _ interface{}) {
+		done <- msg.GetSubject()
+	})
+	router.Handle("order.>", 2, func(msg SubjectMsg, _ Params, _ interface{}) {
+		done <- "catch-all"
+	})
+
+	fresh := fmt.Sprintf("order.%d.created", time.Now().Unix())
+	assert.NoError(t, router.ServeNATS(NewMessage(fresh)))
+	assert.Equal(t, fresh, <-done)
+
+	stale := fmt.Sprintf("order.%d.created", time.Now().Add(-time.Hour).Unix())
+	assert.ErrorIs(t, router.ServeNATS(NewMessage(stale)), ErrExpired)
+	assert.Equal(t, stale, <-expired)
+
+	// Routes without an expiry are dispatched
+	assert.NoError(t, router.ServeNATS(NewMessage("order.unknown.created")))
+	assert.Equal(t, "order.unknown.created", <-done)
+
+	n, err := router.ServeNATSAll(NewMessage(stale))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "catch-all", <-done)
+}
+
+func TestRouterFromNatsHandle(t *testing.T) {
+	router := New()
+	errs := make(chan error, 1)
+	router.ErrorHandler = func(_ SubjectMsg, err error) { errs <- err }
+
+	done := make(chan string, 1)
+	// A handler written for the v1 router
+	v1Handle := func(msg *nats.Msg, ps Params, _ interface{}) {
+		done <- msg.Subject + " " + ps.ByName("p1")
+	}
+	router.HandleWithConcurrency("user.*.ping", 1, 1, router.FromNatsHandle(v1Handle))
+
+	assert.NoError(t, router.ServeNATS(NewNatsMsg(&nats.Msg{Subject: "user.gopher.ping"})))
+	assert.Equal(t, "user.gopher.ping gopher", <-done)
+
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping")))
+	assert.ErrorIs(t, <-errs, ErrNotNatsMsg)
+
+	assert.Panics(t, func() { router.FromNatsHandle(nil) })
+}
+
+func TestRouterLookupStrict(t *testing.T) {
+	router := New()
+	router.Handle("user.:name", 1, func(SubjectMsg, Params, interface{}) {})
+
+	handle, ps, _, err := router.LookupStrict("user.gopher", 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, handle)
+	assert.Equal(t, "gopher", ps.ByName("name"))
+
+	handle, _, _, err = router.LookupStrict("group.admins", 1)
+	assert.NoError(t, err)
+	assert.Nil(t, handle)
+
+	_, _, _, err = router.LookupStrict("user.gopher", 2)
+	assert.ErrorIs(t, err, ErrUnknownRank)
+	assert.EqualError(t, err, "unknown rank 2")
+}
+
+func TestRouterOnRegister(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	var events []string
+	router.OnRegister = func(pattern string, rank int) {
+		events = append(events, fmt.Sprintf("%s@%d", pattern, rank))
+	}
+	router.OnChange = func() { events = append(events, "change") }
+
+	router.Handle("user.*.ping", 1, handlerFunc)
+	router.HandleWithConcurrency("user.>", 2, 1, handlerFunc)
+	assert.Error(t, router.HandleE("user.*.ping", 1, handlerFunc))
+
+	assert.Equal(t, []string{"user.*.ping@1", "change", "user.>@2", "change"}, events)
+}
+
+// Within a rank, a wildcard conflicts with any other token at its place, so
+// overlapping patterns are rejected in either order and no subject is
+// ambiguous; across ranks, the lowest one wins.
+func TestRouterOverlappingPatterns(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	conflicting := [][2]string{
+		{"a.>", "a.b.>"},
+		{"a.>", "a.b"},
+		{"a.*.c", "a.b.c"},
+		{"a.*", "a.b"},
+		{"a.*.>", "a.b.c"},
+		// Conflicting, though not overlapping
+		{"a.*", "a.b.c"},
+		{"a.b", "a.*.c"},
+		{"a.*", "a.>"},
+		{"a.:id", "a.:name"},
+	}
+	for _, pair := range conflicting {
+		for _, order := range [][2]string{pair, {pair[1], pair[0]}} {
+			router := New()
+			assert.NoError(t, router.HandleE(order[0], 1, handlerFunc), order)
+			assert.Error(t, router.HandleE(order[1], 1, handlerFunc), order)
+			assert.Len(t, router.Routes(), 1)
+		}
+	}
+
+	// Different literal tokens, or different lengths past a common wildcard,
+	// do not conflict
+	router := New()
+	assert.NoError(t, router.HandleE("a.b.>", 1, handlerFunc))
+	assert.NoError(t, router.HandleE("a.c.>", 1, handlerFunc))
+	assert.NoError(t, router.HandleE("a.b", 1, handlerFunc))
+	assert.NoError(t, router.HandleE("a.*", 2, handlerFunc))
+	assert.NoError(t, router.HandleE("a.*.c.d", 2, handlerFunc))
+
+	// The lowest rank wins, whether more or less specific
+	router = New()
+	var matched []string
+	for _, route := range []struct {
+		pattern string
+		rank    int
+	}{{"a.>", 1}, {"a.b.>", 2}, {"x.y.>", 1}, {"x.>", 2}} {
+		pattern := route.pattern
+		router.Handle(pattern, route.rank, func(_ SubjectMsg, _ Params, _ interface{}) {
+			matched = append(matched, pattern)
+		})
+	}
+	router.Executor = InlineExecutor
+	assert.NoError(t, router.ServeNATS(NewMessage("a.b.c")))
+	assert.NoError(t, router.ServeNATS(NewMessage("x.y.z")))
+	assert.NoError(t, router.ServeNATS(NewMessage("x.w")))
+	assert.Equal(t, []string{"a.>", "x.y.>", "x.>"}, matched)
+}
+
+func TestRouterTreeStats(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	assert.Empty(t, router.TreeStats())
+
+	router.Handle("user.*.ping", 1, handlerFunc)
+	router.Handle("user.*.pong", 1, handlerFunc)
+	router.Handle("user.>", 2, handlerFunc)
+	router.HandleFallback("group.>", handlerFunc)
+
+	assert.Equal(t, map[int]TreeStat{
+		// "user." > ":p1" > ".p" > "ing" | "ong"
+		1: {Nodes: 5, MaxDepth: 4, MaxFanOut: 2, Wildcards: 1},
+		// "user" > "" > ".*>"
+		2:            {Nodes: 3, MaxDepth: 3, MaxFanOut: 1, CatchAlls: 1},
+		FallbackRank: {Nodes: 3, MaxDepth: 3, MaxFanOut: 1, CatchAlls: 1},
+	}, router.TreeStats())
+}
+
+func TestRouterHitCounts(t *testing.T) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	router := New()
+	router.Executor = InlineExecutor
+	router.Handle("user.*.ping", 1, handlerFunc)
+	router.Handle("user.>", 2, handlerFunc)
+	router.Handle("user.*.ping", 3, handlerFunc)
+	router.Handle("group.:name", 1, handlerFunc)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping")))
+	}
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	assert.NoError(t, router.ServeRank(3, NewMessage("user.gopher.ping"), nil))
+	_, err := router.ServeNATSAll(NewMessage("user.gopher.ping"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]uint64{"user.*.ping": 6, "user.>": 2, "group.:name": 0}, router.HitCounts())
+
+	// Counts follow the routes when the tree is rebuilt
+	router.Handle("user", 1, handlerFunc)
+	assert.True(t, router.Rerank("user.>", 2, 4))
+	assert.Equal(t, map[string]uint64{"user.*.ping": 6, "user.>": 2, "group.:name": 0, "user": 0}, router.HitCounts())
+
+	router.ResetHitCounts()
+	assert.Equal(t, map[string]uint64{"user.*.ping": 0, "user.>": 0, "group.:name": 0, "user": 0}, router.HitCounts())
+
+	// and when their node is split
+	router = New()
+	router.Executor = InlineExecutor
+	router.Handle("user.gopher", 1, handlerFunc)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	router.Handle("user.go", 1, handlerFunc)
+	assert.Equal(t, map[string]uint64{"user.gopher": 1, "user.go": 0}, router.HitCounts())
+}
+
+func TestRouterHandleTyped(t *testing.T) {
+	type created struct{ ID string }
+	type deleted struct{ ID string }
+
+	router := New()
+	router.Executor = InlineExecutor
+	var calls []string
+	errs := make(chan error, 1)
+	router.ErrorHandler = func(_ SubjectMsg, err error) { errs <- err }
+	router.HandleTyped("order.:id", 1, &created{}, func(_ SubjectMsg, _ Params, payload interface{}) {
+		calls = append(calls, "created "+payload.(*created).ID)
+	})
+	router.HandleTyped("order.:id", 1, deleted{}, func(_ SubjectMsg, _ Params, payload interface{}) {
+		calls = append(calls, "deleted "+payload.(deleted).ID)
+	})
+
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("order.1"), &created{ID: "1"}))
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("order.2"), deleted{ID: "2"}))
+	assert.Equal(t, []string{"created 1", "deleted 2"}, calls)
+
+	// No handle for the type, nor a fallback
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("order.3"), created{ID: "3"}))
+	assert.ErrorIs(t, <-errs, ErrUnhandledPayloadType)
+
+	router.HandleTyped("order.:id", 1, nil, func(_ SubjectMsg, _ Params, payload interface{}) {
+		calls = append(calls, fmt.Sprintf("untyped %v", payload))
+	})
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("order.3"), created{ID: "3"}))
+	assert.NoError(t, router.ServeNATS(NewMessage("order.4")))
+	assert.Equal(t, []string{"created 1", "deleted 2", "untyped {3}", "untyped <nil>"}, calls)
+
+	assert.Panics(t, func() {
+		router.HandleTyped("order.:id", 1, &created{}, func(SubjectMsg, Params, interface{}) {})
+	})
+	assert.Panics(t, func() {
+		router.HandleTyped("order.:id", 1, nil, func(SubjectMsg, Params, interface{}) {})
+	})
+	assert.Len(t, router.Routes(), 1)
+
+	// The handles follow the route when reranked, and go when it is removed
+	assert.True(t, router.Rerank("order.:id", 1, 2))
+	router.HandleTyped("order.:id", 2, "", func(_ SubjectMsg, _ Params, payload interface{}) {
+		calls = append(calls, "text "+payload.(string))
+	})
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("order.5"), &created{ID: "5"}))
+	assert.NoError(t, router.ServeNATSWithPayload(NewMessage("order.6"), "6"))
+	assert.Equal(t, []string{"created 5", "text 6"}, calls[4:])
+	assert.Len(t, router.Routes(), 1)
+
+	assert.True(t, router.Remove("order.:id", 2))
+	router.HandleTyped("order.:id", 2, &created{}, func(SubjectMsg, Params, interface{}) {})
+	assert.Len(t, router.Routes(), 1)
+}
+
+// emitMsg is a message telling its reply subject and recording responses.
+type emitMsg struct {
+	subject, reply string
+	responses      [][]byte
+}
+
+func (m *emitMsg) GetMsg() interface{}       { return m }
+func (m *emitMsg) GetSubject() string        { return m.subject }
+func (m *emitMsg) GetReply() string          { return m.reply }
+func (m *emitMsg) Respond(data []byte) error { m.responses = append(m.responses, data); return nil }
+
+// fakePublisher records publications, failing for the subjects in fail.
+type fakePublisher struct {
+	published []string
+	fail      map[string]bool
+}
+
+func (p *fakePublisher) Publish(subject string, data []byte) error {
+	if p.fail[subject] {
+		return errors.New("publish failed")
+	}
+	p.published = append(p.published, subject+" "+string(data))
+
+	return nil
+}
+
+func TestRouterHandleEmit(t *testing.T) {
+	router := New()
+	router.Executor = InlineExecutor
+	pub := &fakePublisher{fail: map[string]bool{"events.order.fail.processed": true}}
+	var failed []string
+	router.ResultPublisher = resultPublisher(pub, func(in string) string { return "events." + in + ".processed" },
+		func(subject string, _ error) { failed = append(failed, subject) })
+	var errs []error
+	router.ErrorHandler = func(_ SubjectMsg, err error) { errs = append(errs, err) }
+	router.HandleEmit("order.:id", 1, func(_ SubjectMsg, ps Params, _ interface{}) ([]byte, error) {
+		switch id := ps.ByName("id"); id {
+		case "bad":
+			return nil, errors.New("bad order")
+		case "none":
+			return nil, nil
+		default:
+			return []byte("ok " + id), nil
+		}
+	})
+
+	// Requests are answered
+	request := &emitMsg{subject: "order.1", reply: "_INBOX.1"}
+	assert.NoError(t, router.ServeNATS(request))
+	assert.Equal(t, [][]byte{[]byte("ok 1")}, request.responses)
+
+	// Events are published
+	event := &emitMsg{subject: "order.2"}
+	assert.NoError(t, router.ServeNATS(event))
+	assert.Empty(t, event.responses)
+	assert.NoError(t, router.ServeNATS(&emitMsg{subject: "order.none"}))
+	assert.NoError(t, router.ServeNATS(&emitMsg{subject: "order.fail"}))
+	assert.Equal(t, []string{"events.order.2.processed ok 2"}, pub.published)
+	assert.Equal(t, []string{"events.order.fail.processed"}, failed)
+
+	assert.NoError(t, router.ServeNATS(&emitMsg{subject: "order.bad"}))
+	assert.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "'order.bad': bad order")
+}
+
+func TestRouterValidateIncoming(t *testing.T) {
+	router := New()
+	router.Executor = InlineExecutor
+	router.ValidateIncoming = true
+	router.Handle("user.>", 1, func(SubjectMsg, Params, interface{}) {})
+
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("group.admins")), ErrNotFound)
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping")))
+	for subject, reason := range map[string]string{
+		"":              "empty subject",
+		"user..ping":    "empty token 2 in 'user..ping'",
+		"user.gopher.":  "empty token 3 in 'user.gopher.'",
+		"user.*.ping":   "wildcard '*' in 'user.*.ping'",
+		"user.>":        "wildcard '>' in 'user.>'",
+		"user.go pher":  "invalid character ' ' in 'user.go pher'",
+		"user.\tgopher": "invalid character '\\t' in 'user.\tgopher'",
+	} {
+		err := router.ServeNATS(NewMessage(subject))
+		assert.ErrorIs(t, err, ErrInvalidSubject, subject)
+		assert.EqualError(t, err, "invalid subject: "+reason)
+	}
+
+	// Normalized subjects are checked as matched
+	router.NormalizeSubject = true
+	assert.NoError(t, router.ServeNATS(NewMessage("user..gopher.ping")))
+
+	router.ValidateIncoming = false
+	router.NormalizeSubject = false
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("group..admins")), ErrNotFound)
+}
+
+func TestRouterHandleFallback(t *testing.T) {
+	router := New()
+	router.Executor = InlineExecutor
+	var calls []string
+	handle := func(name string) Handle {
+		return func(_ SubjectMsg, _ Params, _ interface{}) { calls = append(calls, name) }
+	}
+	router.Handle("user.:name", 1, handle("user"))
+	router.Handle("user.:name.ping", 2, handle("ping"))
+	router.HandleFallback("user.>", handle("fallback"))
+	notFound := 0
+	router.NotFoundHandler = func(SubjectMsg, interface{}) { notFound++ }
+
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher")))
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.ping")))
+	// Fallback wins over NotFoundHandler
+	assert.NoError(t, router.ServeNATS(NewMessage("user.gopher.pong")))
+	assert.ErrorIs(t, router.ServeNATS(NewMessage("group.admins")), ErrNotFound)
+	assert.Equal(t, []string{"user", "ping", "fallback"}, calls)
+	assert.Equal(t, 1, notFound)
+
+	// Only consulted once every rank missed
+	n, err := router.ServeNATSAll(NewMessage("user.gopher.ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, router.MatchAll("user.gopher.pong"), 1)
+	assert.Equal(t, FallbackRank, router.MatchAll("user.gopher.pong")[0].Rank)
+
+	// Kept apart from the ranks, and may overlap them
+	assert.Equal(t, []int{1, 2}, router.Ranks())
+	assert.Contains(t, router.Routes(), RouteInfo{Pattern: "user.>", Path: "user.*>", Rank: FallbackRank})
+	assert.Contains(t, router.Subjects(), "user.>")
+	router.WarnOnRankShadow = true
+	router.Handle("team.*", 1, handle("team"))
+	assert.NotPanics(t, func() { router.HandleFallback("team.*", handle("fallback")) })
+}
+
+func TestRouterHandleFallbackFirst(t *testing.T) {
+	router := New()
+	router.HandleFallback("user.>", func(_ SubjectMsg, _ Params, _ interface{}) {})
+	router.Handle("user.:name", 1, func(_ SubjectMsg, _ Params, _ interface{}) {})
+
+	assert.Equal(t, []int{1}, router.Ranks())
+	pattern, rank, err := router.ServeNATSMatched(NewMessage("user.gopher"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user.:name", pattern)
+	assert.Equal(t, 1, rank)
+	pattern, rank, err = router.ServeNATSMatched(NewMessage("user.gopher.ping"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user.>", pattern)
+	assert.Equal(t, FallbackRank, rank)
+}
+
+func TestRouterServeNATSEmptyConcurrent(t *testing.T) {
+	router := New()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.ErrorIs(t, router.ServeNATS(NewMessage("user.gopher")), ErrNotFound)
+			assert.Empty(t, router.Ranks())
+			_, _ = router.ServeNATSAll(NewMessage("user.gopher"))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRouterInternTokens(t *testing.T) {
+	router := New()
+	router.InternTokens = true
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	for rank := 1; rank <= 2; rank++ {
+		// Built at runtime, so that each pattern has its own storage
+		router.Handle(fmt.Sprintf("tenant.*.%s.>", "ROUTING"), rank, handlerFunc)
+	}
+
+	routes := router.Routes()
+	assert.Len(t, routes, 2)
+	assert.Equal(t, routes[0].Path, routes[1].Path)
+	assert.Equal(t, unsafe.StringData(routes[0].Path), unsafe.StringData(routes[1].Path))
+	assert.Equal(t, unsafe.StringData(routes[0].Pattern), unsafe.StringData(routes[1].Pattern))
+	assert.Len(t, router.interned, 2)
+
+	handle, ps, _ := router.Lookup("tenant.acme.ROUTING.v2", 2)
+	assert.NotNil(t, handle)
+	assert.Equal(t, "acme", ps.ByName("p1"))
+
+	// A conflicting route keeps nothing interned
+	assert.Panics(t, func() { router.Handle("tenant.*.ROUTING.v2", 1, handlerFunc) })
+	assert.Len(t, router.interned, 2)
+
+	// The strings are released with the last route using them
+	assert.True(t, router.Rerank("tenant.*.ROUTING.>", 1, 3))
+	assert.True(t, router.Remove("tenant.*.ROUTING.>", 3))
+	assert.Len(t, router.interned, 2)
+	assert.True(t, router.Remove("tenant.*.ROUTING.>", 2))
+	assert.Empty(t, router.interned)
+
+	// Swap interns the routes of the other router
+	other := New()
+	other.Handle("user.*.ping", 1, handlerFunc)
+	router.Swap(other)
+	assert.Len(t, router.interned, 2)
+	assert.True(t, router.Remove("user.*.ping", 1))
+	assert.Empty(t, router.interned)
+}
+
+func TestRankList(t *testing.T) {
+	r := New()
+	r.rankIndexList = []int{2, 4, 1, 3}
+	assert.False(t, r.initialized)
+	rankList := r.getRankList()
+	assert.True(t, r.initialized)
+	assert.Equal(t, 1, rankList[0])
+	assert.Equal(t, 2, rankList[1])
+	assert.Equal(t, 3, rankList[2])
+	assert.Equal(t, 4, rankList[3])
+}
+
+// BenchmarkInternTokens reports the heap retained by a large synthetic
+// routing table, registered at several ranks.
+func BenchmarkInternTokens(b *testing.B) {
+	handlerFunc := func(_ SubjectMsg, _ Params, _ interface{}) {}
+	const services, ranks = 5000, 4
+
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("InternTokens=%t", intern), func(b *testing.B) {
+			var retained uint64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				router := New()
+				router.InternTokens = intern
+				for rank := 1; rank <= ranks; rank++ {
+					for svc := 0; svc < services; svc++ {
+						router.Handle(fmt.Sprintf("tenant.*.svc%d.ROUTING.v2.*.>", svc), rank, handlerFunc)
+					}
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(router)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N*services*ranks), "B/route")
+		})
+	}
 }
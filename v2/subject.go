@@ -0,0 +1,107 @@
+package natsrouter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Join builds a subject from its tokens, e.g. Join("ROUTING.v2", "*", ">")
+// returns "ROUTING.v2.*.>".
+// Tokens may themselves hold several tokens; leading and trailing
+// separators are trimmed and empty tokens skipped.
+func Join(tokens ...string) string {
+	var sb strings.Builder
+	for _, token := range tokens {
+		token = strings.Trim(token, ".")
+		if token == "" {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(token)
+	}
+
+	return sb.String()
+}
+
+// Split returns the tokens of a subject, e.g. Split("ROUTING.v2.*.>")
+// returns ["ROUTING" "v2" "*" ">"]. An empty subject has no tokens.
+func Split(subject string) []string {
+	if subject == "" {
+		return nil
+	}
+
+	return strings.Split(subject, ".")
+}
+
+// validatePattern checks that a pattern only holds tokens allowed in NATS
+// subjects: literal tokens without whitespace or control characters, '*'
+// wildcards, ':name' params and a trailing '>' catch-all.
+func validatePattern(pattern string) error {
+	tokens := Split(pattern)
+	if len(tokens) == 0 {
+		return errors.New("empty pattern")
+	}
+
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return fmt.Errorf("empty token %d in pattern '%s'", i+1, pattern)
+		case token == "*":
+			continue
+		case token == ">":
+			if i != len(tokens)-1 {
+				return fmt.Errorf("'>' must be the last token in pattern '%s'", pattern)
+			}
+
+			continue
+		case strings.ContainsAny(token, "*>"):
+			return fmt.Errorf("wildcard mixed with other characters in token '%s' of pattern '%s'", token, pattern)
+		case strings.LastIndexByte(token, ':') > 0:
+			return fmt.Errorf("':' must start the token '%s' of pattern '%s'", token, pattern)
+		case token == ":":
+			return fmt.Errorf("unnamed param in pattern '%s'", pattern)
+		}
+
+		for _, c := range token {
+			if unicode.IsSpace(c) || unicode.IsControl(c) {
+				return fmt.Errorf("invalid character %q in token '%s' of pattern '%s'", c, token, pattern)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ErrInvalidSubject is returned by ServeNATS for illegal subjects, if
+// Router.ValidateIncoming is set. The returned error wraps it with the
+// reason.
+var ErrInvalidSubject = errors.New("invalid subject")
+
+// validateSubject checks that a subject can be published in NATS: non-empty
+// literal tokens without wildcards, whitespace or control characters.
+func validateSubject(subject string) error {
+	if subject == "" {
+		return fmt.Errorf("%w: empty subject", ErrInvalidSubject)
+	}
+
+	for i, token := range Split(subject) {
+		switch {
+		case token == "":
+			return fmt.Errorf("%w: empty token %d in '%s'", ErrInvalidSubject, i+1, subject)
+		case token == "*" || token == ">":
+			return fmt.Errorf("%w: wildcard '%s' in '%s'", ErrInvalidSubject, token, subject)
+		}
+
+		for _, c := range token {
+			if unicode.IsSpace(c) || unicode.IsControl(c) {
+				return fmt.Errorf("%w: invalid character %q in '%s'", ErrInvalidSubject, c, subject)
+			}
+		}
+	}
+
+	return nil
+}
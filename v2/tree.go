@@ -2,6 +2,7 @@ package natsrouter
 
 import (
 	"strings"
+	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
 )
@@ -70,6 +71,7 @@ const (
 	root
 	param
 	catchAll
+	plus
 )
 
 type node struct {
@@ -80,6 +82,72 @@ type node struct {
 	priority  uint32
 	children  []*node
 	handle    Handle
+	fullPath  string
+	// Pattern of the route, as passed to Handle
+	pattern  string
+	inline   bool
+	disabled bool
+	// Limits the concurrent calls of the handle, see HandleWithConcurrency
+	sem chan struct{}
+	// Payload of messages served without one, see HandleWithDefaultPayload
+	payload interface{}
+	// Dispatches of the handle, see HitCounts
+	hits atomic.Uint64
+}
+
+// copyFlags copies the per-route settings of another leaf node.
+func (n *node) copyFlags(from *node) {
+	n.pattern = from.pattern
+	n.inline, n.disabled, n.sem, n.payload = from.inline, from.disabled, from.sem, from.payload
+	n.hits.Store(from.hits.Load())
+}
+
+// value returns the handle of a leaf node and the node itself.
+// The handle of a disabled node is nil.
+func (n *node) value() (Handle, *node) {
+	if n.disabled {
+		return nil, n
+	}
+
+	return n.handle, n
+}
+
+// walk calls fn for n and its descendants, depth first, until fn returns
+// false. It reports whether the walk completed.
+func (n *node) walk(fn func(*node) bool) bool {
+	if !fn(n) {
+		return false
+	}
+	for _, child := range n.children {
+		if !child.walk(fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// stats adds the shape of the subtree of n, at the given depth, to st.
+func (n *node) stats(depth int, st *TreeStat) {
+	st.Nodes++
+	if depth > st.MaxDepth {
+		st.MaxDepth = depth
+	}
+	if len(n.children) > st.MaxFanOut {
+		st.MaxFanOut = len(n.children)
+	}
+	switch n.nType {
+	case param, plus:
+		st.Wildcards++
+	case catchAll:
+		// A catch-all is made of an empty node and the node holding it
+		if n.path != "" {
+			st.CatchAlls++
+		}
+	}
+	for _, child := range n.children {
+		child.stats(depth+1, st)
+	}
 }
 
 // Increments priority of the given child and reorders if necessary
@@ -106,8 +174,12 @@ func (n *node) incrementChildPrio(pos int) int {
 }
 
 // addRoute adds a node with the given handle to the path.
+// ref is the reference to n, e.g. the root of the tree, which is replaced
+// by a new node if n has to be split: existing nodes are never moved to
+// another object, so that the leaf nodes held by the handles being served
+// stay valid.
 // Not concurrency-safe!
-func (n *node) addRoute(path string, handle Handle) {
+func (n *node) addRoute(path string, handle Handle, ref **node) {
 	fullPath := path
 	n.priority++
 
@@ -126,24 +198,22 @@ walk:
 		// since the existing key can't contain those chars.
 		i := longestCommonPrefix(path, n.path)
 
-		// Split edge
+		// Split edge: a new node takes the common prefix and the place of n,
+		// which keeps the rest, its handle and its per-route settings
 		if i < len(n.path) {
-			child := node{
-				path:      n.path[i:],
-				wildChild: n.wildChild,
-				nType:     static,
-				indices:   n.indices,
-				children:  n.children,
-				handle:    n.handle,
-				priority:  n.priority - 1,
+			prefix := &node{
+				path:     n.path[:i],
+				nType:    n.nType,
+				children: []*node{n},
+				// []byte for proper unicode char conversion, see #65
+				indices:  string([]byte{n.path[i]}),
+				priority: n.priority,
 			}
-
-			n.children = []*node{&child}
-			// []byte for proper unicode char conversion, see #65
-			n.indices = string([]byte{n.path[i]})
-			n.path = path[:i]
-			n.handle = nil
-			n.wildChild = false
+			n.path = n.path[i:]
+			n.nType = static
+			n.priority--
+			*ref = prefix
+			n = prefix
 		}
 
 		// Make new node a child of this node
@@ -151,6 +221,7 @@ walk:
 			path = path[i:]
 
 			if n.wildChild {
+				ref = &n.children[0]
 				n = n.children[0]
 				n.priority++
 
@@ -179,7 +250,8 @@ walk:
 			idxc := path[0]
 
 			// '.' after param
-			if n.nType == param && idxc == '.' && len(n.children) == 1 {
+			if (n.nType == param || n.nType == plus) && idxc == '.' && len(n.children) == 1 {
+				ref = &n.children[0]
 				n = n.children[0]
 				n.priority++
 
@@ -190,6 +262,7 @@ walk:
 			for i, c := range []byte(n.indices) {
 				if c == idxc {
 					i = n.incrementChildPrio(i)
+					ref = &n.children[i]
 					n = n.children[i]
 
 					continue walk
@@ -215,6 +288,7 @@ walk:
 			panic("a handle is already registered for path '" + fullPath + "'")
 		}
 		n.handle = handle
+		n.fullPath = fullPath
 
 		return
 	}
@@ -259,6 +333,13 @@ func (n *node) insertChild(path, fullPath string, handle Handle) {
 				nType: param,
 				path:  wildcard,
 			}
+			// A ':+name' wildcard matches one or more tokens
+			if wildcard[1] == '+' {
+				if len(wildcard) < 3 {
+					panic("wildcards must be named with a non-empty name in path '" + fullPath + "'")
+				}
+				child.nType = plus
+			}
 			n.children = []*node{child}
 			n = child
 			n.priority++
@@ -278,6 +359,7 @@ func (n *node) insertChild(path, fullPath string, handle Handle) {
 
 			// Otherwise we're done. Insert the handle in the new leaf
 			n.handle = handle
+			n.fullPath = fullPath
 
 			return
 		}
@@ -314,6 +396,7 @@ func (n *node) insertChild(path, fullPath string, handle Handle) {
 			path:     path[i:],
 			nType:    catchAll,
 			handle:   handle,
+			fullPath: fullPath,
 			priority: 1,
 		}
 		n.children = []*node{child}
@@ -324,14 +407,17 @@ func (n *node) insertChild(path, fullPath string, handle Handle) {
 	// If no wildcard was found, simply insert the path and handle
 	n.path = path
 	n.handle = handle
+	n.fullPath = fullPath
 }
 
-// Returns the handle registered with the given path (key). The values of
-// wildcards are saved to a map.
+// Returns the handle registered with the given path (key) and the leaf node
+// holding it. The handle of a disabled leaf is nil, but the leaf is still
+// returned. The values of wildcards are saved to a map.
+// If trimCatchAll is set, the leading '.' is stripped from the catch-all value.
 // If no handle can be found, a TSR (trailing slash redirect) recommendation is
 // made if a handle exists with an extra (without the) trailing slash for the
 // given path.
-func (n *node) getValue(path string, params func() *Params) (handle Handle, ps *Params, tsr bool) {
+func (n *node) getValue(path string, params func() *Params, trimCatchAll bool) (handle Handle, ps *Params, leaf *node, tsr bool) {
 walk: // Outer loop for walking the tree
 	for {
 		prefix := n.path
@@ -399,7 +485,9 @@ walk: // Outer loop for walking the tree
 						return
 					}
 
-					if handle = n.handle; handle != nil {
+					if n.handle != nil {
+						handle, leaf = n.value()
+
 						return
 					} else if len(n.children) == 1 {
 						// No handle found. Check if a handle for this path + a
@@ -411,24 +499,80 @@ walk: // Outer loop for walking the tree
 					return
 
 				case catchAll:
+					// The catch-all node path starts with the '.' separator
+					// (e.g. ".*>"), so the remainder captured here keeps it.
+					// This is intended, not an off-by-one: it mirrors the
+					// leading '/' of httprouter catch-all values and lets
+					// consumers rebuild the subject by concatenation.
 					// Save param value
 					if params != nil {
 						if ps == nil {
 							ps = params()
 						}
+						value := path
+						if trimCatchAll {
+							value = path[1:]
+						}
 						// Expand slice within preallocated capacity
 						i := len(*ps)
 						*ps = (*ps)[:i+1]
 						(*ps)[i] = Param{
 							Key:   n.path[2:],
-							Value: path,
+							Value: value,
 						}
 					}
 
-					handle = n.handle
+					handle, leaf = n.value()
 
 					return
 
+				case plus:
+					// Consume as few tokens as possible: try the rest of the
+					// route after each token, rolling back the params saved
+					// by failed attempts.
+					mark := 0
+					if params != nil {
+						if ps == nil {
+							ps = params()
+						}
+						mark = len(*ps)
+					}
+					// Capture a copy, so that ps is not moved to the heap
+					// on every lookup
+					var rest func() *Params
+					if saved := ps; params != nil {
+						rest = func() *Params { return saved }
+					}
+
+					end := 0
+					for {
+						for end < len(path) && path[end] != '.' {
+							end++
+						}
+						if params != nil {
+							*ps = append((*ps)[:mark], Param{
+								Key:   n.path[2:],
+								Value: path[:end],
+							})
+						}
+
+						if end == len(path) {
+							if n.handle != nil {
+								handle, leaf = n.value()
+							}
+
+							return
+						}
+						if len(n.children) > 0 {
+							if h, _, l, _ := n.children[0].getValue(path[end:], rest, trimCatchAll); h != nil || l != nil {
+								handle, leaf = h, l
+
+								return
+							}
+						}
+						end++
+					}
+
 				default:
 					panic("invalid node type")
 				}
@@ -436,7 +580,9 @@ walk: // Outer loop for walking the tree
 		} else if path == prefix {
 			// We should have reached the node containing the handle.
 			// Check if this node has a handle registered.
-			if handle = n.handle; handle != nil {
+			if n.handle != nil {
+				handle, leaf = n.value()
+
 				return
 			}
 
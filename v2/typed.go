@@ -0,0 +1,99 @@
+package natsrouter
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ErrUnhandledPayloadType is reported to Router.ErrorHandler when a route
+// registered with HandleTyped has no handle for the type of the payload.
+var ErrUnhandledPayloadType = errors.New("no handle for payload type")
+
+// typedRoute holds the handles of a route registered with HandleTyped.
+type typedRoute struct {
+	mu       sync.RWMutex
+	byType   map[reflect.Type]Handle
+	fallback Handle
+}
+
+// add adds the handle of the type of sample, or the fallback if nil.
+func (t *typedRoute) add(path string, sample interface{}, handle Handle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if sample == nil {
+		if t.fallback != nil {
+			panic("an untyped handle is already registered for path '" + path + "'")
+		}
+		t.fallback = handle
+
+		return
+	}
+	typ := reflect.TypeOf(sample)
+	if _, ok := t.byType[typ]; ok {
+		panic(fmt.Sprintf("a handle is already registered for type %s for path '%s'", typ, path))
+	}
+	t.byType[typ] = handle
+}
+
+// handleFor returns the handle of the dynamic type of payload, the fallback,
+// or nil.
+func (t *typedRoute) handleFor(payload interface{}) Handle {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if payload != nil {
+		if handle, ok := t.byType[reflect.TypeOf(payload)]; ok {
+			return handle
+		}
+	}
+
+	return t.fallback
+}
+
+// HandleTyped registers a new request handle with the given path and rank,
+// run for the payloads of the dynamic type of sample, e.g. &OrderCreated{},
+// so that a subject carrying several payload schemas is dispatched to a
+// handle per schema. Call it once per type; with a nil sample, it registers
+// the handle of the payloads of any other type, and of nil ones.
+// Payloads without a handle are reported to the ErrorHandler with
+// ErrUnhandledPayloadType.
+// The path must not be registered with Handle or any of its other variants.
+func (r *Router) HandleTyped(path string, rank int, sample interface{}, handle Handle) {
+	if handle == nil {
+		panic("handle must not be nil")
+	}
+	key := routeKey{r.routerPath(path), rank}
+
+	r.mu.RLock()
+	route := r.typed[key]
+	r.mu.RUnlock()
+	if route != nil {
+		route.add(path, sample, handle)
+
+		return
+	}
+
+	route = &typedRoute{byType: make(map[reflect.Type]Handle)}
+	route.add(path, sample, handle)
+	r.Handle(path, rank, func(msg SubjectMsg, ps Params, payload interface{}) {
+		handle := route.handleFor(payload)
+		if handle == nil {
+			if r.ErrorHandler != nil {
+				r.ErrorHandler(msg, fmt.Errorf("%w %T", ErrUnhandledPayloadType, payload))
+			}
+
+			return
+		}
+		handle(msg, ps, payload)
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.typed == nil {
+		r.typed = make(map[routeKey]*typedRoute)
+	}
+	r.typed[key] = route
+}